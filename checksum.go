@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// hashes that can be given to -checksum, each one names its sidecar file.
+var checksumHashes = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+type checksumWriter struct {
+	// tees everything written to an output file through a hash, closing it
+	// writes the sum next to the file.
+	io.WriteCloser
+	hash     hash.Hash
+	path     string
+	fileData inputFile
+}
+
+func (w *checksumWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	w.hash.Write(p[:n])
+	return n, err
+}
+
+func (w *checksumWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+	// the sidecar uses the sha256sum layout so `sha256sum -c` can check it.
+	sum := hex.EncodeToString(w.hash.Sum(nil))
+	line := fmt.Sprintf("%s  %s\n", sum, filepath.Base(w.path))
+	sumPath := w.path + "." + w.fileData.checksum
+	if err := os.WriteFile(sumPath, []byte(line), 0644); err != nil {
+		return writeFailure(sumPath, err)
+	}
+	printStatus(w.fileData, "%s %s  %s\n", w.fileData.checksum, sum, w.path)
+	return nil
+}
+
+func withChecksum(w io.WriteCloser, path string, fileData inputFile) io.WriteCloser {
+	// without -checksum the writer is used as it is.
+	newHash, ok := checksumHashes[fileData.checksum]
+	if !ok {
+		return w
+	}
+	return &checksumWriter{w, newHash(), path, fileData}
+}
+
+func recordHash(record map[string]interface{}) string {
+	// json.Marshal writes map keys sorted, so the same columns and values
+	// always give the same hash whatever order they were read in.
+	data, _ := json.Marshal(record)
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+)
+
+type headerDiff struct {
+	Input   string   `json:"input"`
+	Other   string   `json:"other"`
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+}
+
+func fileHeaders(fileData inputFile) []string {
+	// the header is read with every option that changes it, nothing after
+	// it is looked at.
+	file, _, err := openInput(fileData)
+	check(err)
+	defer file.Close()
+	_, headers := readCSVHeader(file, fileData, &conversionReport{})
+	return headers
+}
+
+func compareHeaders(fileData inputFile, out io.Writer) error {
+	// columns only the -compare file has are added, columns only the input
+	// has are removed, both in header order.
+	otherData := fileData
+	otherData.filepath = fileData.compare
+	inputHeaders := fileHeaders(fileData)
+	otherHeaders := fileHeaders(otherData)
+	diff := headerDiff{Input: fileData.filepath, Other: fileData.compare, Added: []string{}, Removed: []string{}}
+	for _, name := range otherHeaders {
+		if !contains(inputHeaders, name) {
+			diff.Added = append(diff.Added, name)
+		}
+	}
+	for _, name := range inputHeaders {
+		if !contains(otherHeaders, name) {
+			diff.Removed = append(diff.Removed, name)
+		}
+	}
+	diffData, err := json.MarshalIndent(diff, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(append(diffData, '\n'))
+	return err
+}
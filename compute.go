@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type computeTerm struct {
+	// either a column to read or a literal to use as is
+	column  string
+	literal string
+}
+
+type computedField struct {
+	// a -compute field, its value is the terms joined together
+	name  string
+	terms []computeTerm
+}
+
+func parseCompute(spec string) (computedField, error) {
+	// the grammar is name=term+term..., where a term is a column name or a
+	// literal in single or double quotes, e.g. fullname=first+' '+last.
+	name, expression, found := strings.Cut(spec, "=")
+	name = strings.TrimSpace(name)
+	if !found || name == "" {
+		return computedField{}, fmt.Errorf("-compute %s must be in the form name=expression", spec)
+	}
+	field := computedField{name: name}
+	rest := strings.TrimSpace(expression)
+	for {
+		if rest == "" {
+			return computedField{}, fmt.Errorf("-compute %s is missing a term", spec)
+		}
+		var term computeTerm
+		if quote := rest[0]; quote == '\'' || quote == '"' {
+			end := strings.IndexByte(rest[1:], quote)
+			if end < 0 {
+				return computedField{}, fmt.Errorf("-compute %s has an unterminated literal", spec)
+			}
+			term.literal = rest[1 : end+1]
+			rest = rest[end+2:]
+		} else {
+			end := strings.IndexByte(rest, '+')
+			if end < 0 {
+				end = len(rest)
+			}
+			term.column = strings.TrimSpace(rest[:end])
+			if term.column == "" {
+				return computedField{}, fmt.Errorf("-compute %s is missing a term", spec)
+			}
+			rest = rest[end:]
+		}
+		field.terms = append(field.terms, term)
+
+		rest = strings.TrimSpace(rest)
+		if rest == "" {
+			return field, nil
+		}
+		if rest[0] != '+' {
+			return computedField{}, errors.New("-compute terms must be joined with +")
+		}
+		rest = strings.TrimSpace(rest[1:])
+	}
+}
+
+func (field computedField) checkColumns(headers []string) error {
+	// columns are checked once against the header rather than on every row.
+	for _, term := range field.terms {
+		if term.column != "" && !contains(headers, term.column) {
+			return fmt.Errorf("Compute column %s is not in the header", term.column)
+		}
+	}
+	if contains(headers, field.name) {
+		return fmt.Errorf("Compute field %s is already a column in the header", field.name)
+	}
+	return nil
+}
+
+func (field computedField) evaluate(record map[string]interface{}) string {
+	var value strings.Builder
+	for _, term := range field.terms {
+		if term.column != "" {
+			value.WriteString(csvValue(record[term.column]))
+		} else {
+			value.WriteString(term.literal)
+		}
+	}
+	return value.String()
+}
+
+func isComputed(fields []computedField, name string) bool {
+	for _, field := range fields {
+		if field.name == name {
+			return true
+		}
+	}
+	return false
+}
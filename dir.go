@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+func isDirectory(path string) bool {
+	if isURL(path) || path == stdioPath {
+		return false
+	}
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+func directoryFiles(dir string, extension string) ([]string, error) {
+	// only the files directly inside the directory are converted, in name
+	// order, sub directories are left alone.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, withExitCode(exitNotFound, err)
+	}
+	var files []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && hasExtension(entry.Name(), extension) {
+			files = append(files, filepath.Join(dir, entry.Name()))
+		}
+	}
+	sort.Strings(files)
+	if len(files) == 0 {
+		return nil, withExitCode(exitNotFound, fmt.Errorf("Directory %s has no %s files", dir, strings.ToUpper(strings.TrimPrefix(extension, "."))))
+	}
+	return files, nil
+}
+
+type fileJob struct {
+	// one input of a directory or archive, named the way the user knows it,
+	// with where its output goes when that isn't next to the input. A job
+	// that couldn't be set up has the reason instead.
+	name   string
+	input  string
+	output string
+	err    error
+}
+
+func convertDirectory(fileData inputFile, extension string) error {
+	files, err := directoryFiles(fileData.filepath, extension)
+	if err != nil {
+		return err
+	}
+	var jobs []fileJob
+	for _, file := range files {
+		jobs = append(jobs, fileJob{name: file, input: file})
+	}
+	return runConversions(fileData, jobs)
+}
+
+func runConversions(fileData inputFile, jobs []fileJob) error {
+	// every file is converted by running this program again on it with the
+	// same flags, so a file that fails exits on its own without stopping the
+	// others. -parallel-files of them run at once. The flags of a job go
+	// after the user's and before a -- that ends them, so the user's own --
+	// or a file name starting with - can't turn them into paths.
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	flags := os.Args[1 : len(os.Args)-flag.NArg()]
+	if len(flags) > 0 && flags[len(flags)-1] == "--" {
+		flags = flags[:len(flags)-1]
+	}
+
+	queue := make(chan fileJob)
+	var failed []string
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < fileData.parallelFiles; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				if job.err != nil {
+					fmt.Fprintf(os.Stderr, "error: %v\n", job.err)
+					mutex.Lock()
+					failed = append(failed, job.name)
+					mutex.Unlock()
+					continue
+				}
+				args := append([]string(nil), flags...)
+				if job.output != "" {
+					args = append(args, "-output", job.output)
+				}
+				cmd := exec.Command(executable, append(args, "--", job.input)...)
+				cmd.Stdout = os.Stdout
+				cmd.Stderr = os.Stderr
+				if err := cmd.Run(); err != nil {
+					mutex.Lock()
+					failed = append(failed, job.name)
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+	for _, job := range jobs {
+		queue <- job
+	}
+	close(queue)
+	wg.Wait()
+
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("%d of %d files failed: %s", len(failed), len(jobs), strings.Join(failed, ", "))
+	}
+	printStatus(fileData, "Converted %d files\n", len(jobs))
+	return nil
+}
@@ -0,0 +1,5 @@
+module github.com/gluk0/go-csv-to-json
+
+go 1.21
+
+require golang.org/x/text v0.22.0
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+type recordIndex struct {
+	// the byte offset of each record line in one output file, by the value
+	// of the -index-by column, in the order the lines were written.
+	column  string
+	keys    []string
+	offsets map[string]interface{}
+}
+
+func (index *recordIndex) add(record map[string]interface{}, offset int64) error {
+	key, err := recordKey(record, index.column)
+	if err != nil {
+		return err
+	}
+	if _, seen := index.offsets[key]; seen {
+		return fmt.Errorf("Key %s appears more than once in column %s", key, index.column)
+	}
+	if index.offsets == nil {
+		index.offsets = make(map[string]interface{})
+	}
+	index.keys = append(index.keys, key)
+	index.offsets[key] = offset
+	return nil
+}
+
+func (index *recordIndex) write(path string) error {
+	// the index goes next to the file it describes as path.idx, a JSON
+	// object such as {"1":0,"2":37}, and starts again for the next file.
+	indexPath := path + ".idx"
+	indexData, err := marshalOrdered(index.offsets, index.keys)
+	if err != nil {
+		return err
+	}
+	index.keys, index.offsets = nil, nil
+	return writeFailure(indexPath, os.WriteFile(indexPath, append(indexData, '\n'), 0644))
+}
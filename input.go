@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func isURL(location string) bool {
+	// http and https inputs are fetched, anything else is a local path.
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
+
+// the path that stands for standard input, and for standard output with -output.
+const stdioPath = "-"
+
+type nopWriteCloser struct {
+	// standard output is left open for whatever runs after the conversion.
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func inputBaseName(location string) string {
+	// the file name an input goes by, for URLs the last part of the path.
+	if location == stdioPath {
+		return "stdin"
+	}
+	if !isURL(location) {
+		return filepath.Base(location)
+	}
+	if parsed, err := url.Parse(location); err == nil {
+		if name := path.Base(parsed.Path); name != "/" && name != "." {
+			return name
+		}
+	}
+	return "output.csv"
+}
+
+func hasExtension(name string, extension string) bool {
+	// extensions match in any case, so DATA.CSV is a CSV file too.
+	return strings.EqualFold(filepath.Ext(name), extension)
+}
+
+func trimExtension(name string, extension string) string {
+	if hasExtension(name, extension) {
+		return name[:len(name)-len(extension)]
+	}
+	return name
+}
+
+func safeFileName(name string) string {
+	// a name taken from a URL is decoded, so it can hold characters that some
+	// file system doesn't allow in a name. Those of any of them, Windows
+	// included, and control characters become _ on every system, so the same
+	// URL always gives the same output name. A name of only . or .. would
+	// stand for a directory and becomes _ or __.
+	if name == "." || name == ".." {
+		return strings.Repeat("_", len(name))
+	}
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`<>:"/\|?*`, r) || r < ' ' || r == 0x7f {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+func inputDir(location string) string {
+	// output goes next to a local input, or in the working directory for URLs
+	// and standard input.
+	if isURL(location) || location == stdioPath {
+		return "."
+	}
+	return filepath.Dir(location)
+}
+
+func openInput(fileData inputFile) (io.ReadCloser, io.ReaderAt, error) {
+	// open the local file or start the download. Local files can also be
+	// read back at an offset, which a download or standard input can't.
+	if fileData.filepath == stdioPath {
+		return io.NopCloser(os.Stdin), nil, nil
+	}
+	if !isURL(fileData.filepath) {
+		file, err := os.Open(fileData.filepath)
+		if err != nil {
+			return nil, nil, withExitCode(exitNotFound, err)
+		}
+		return file, file, nil
+	}
+	body, err := fetchURL(fileData)
+	if err != nil {
+		return nil, nil, withExitCode(exitNotFound, err)
+	}
+	return body, nil, nil
+}
+
+type cancelOnClose struct {
+	// a response body that releases its request context when closed
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (body cancelOnClose) Close() error {
+	defer body.cancel()
+	return body.ReadCloser.Close()
+}
+
+func fetchURL(fileData inputFile) (io.ReadCloser, error) {
+	// each attempt gets the whole -timeout, covering the download as well as
+	// the request. Network errors and server errors are retried up to
+	// -retries times with a growing pause, anything else fails straight away.
+	client := &http.Client{}
+	var lastErr error
+	for attempt := 0; attempt <= fileData.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * 500 * time.Millisecond)
+		}
+		var ctx context.Context
+		var cancel context.CancelFunc
+		if fileData.timeout > 0 {
+			ctx, cancel = context.WithTimeout(context.Background(), fileData.timeout)
+		} else {
+			ctx, cancel = context.WithCancel(context.Background())
+		}
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, fileData.filepath, nil)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		response, err := client.Do(request)
+		if err != nil {
+			cancel()
+			lastErr = err
+			continue
+		}
+		if response.StatusCode == http.StatusOK {
+			return cancelOnClose{response.Body, cancel}, nil
+		}
+		response.Body.Close()
+		cancel()
+		lastErr = fmt.Errorf("Fetching %s failed: %s", fileData.filepath, response.Status)
+		if response.StatusCode < 500 {
+			break
+		}
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+func recordKey(record map[string]interface{}, column string) (string, error) {
+	// typed values are keyed by their JSON text, so 1 and "1" are the same key.
+	switch value := record[column].(type) {
+	case nil:
+		return "", fmt.Errorf("A record has no value for the key column %s", column)
+	case string:
+		return value, nil
+	default:
+		text, err := json.Marshal(value)
+		return strings.Trim(string(text), `"`), err
+	}
+}
+
+func writeJSONMap(fileData inputFile, writerChannel <-chan map[string]interface{}, done chan<- bool, report *conversionReport) {
+	// -as-map writes one object keyed by a column instead of an array. A
+	// repeated key either fails the run or replaces the earlier record,
+	// which keeps its place, so every record is held until the input ends.
+	var keys []string
+	records := make(map[string]map[string]interface{})
+	for record := range writerChannel {
+		key, err := recordKey(record, fileData.asMap)
+		check(withExitCode(exitParse, err))
+		if _, seen := records[key]; !seen {
+			keys = append(keys, key)
+		} else if fileData.mapDuplicates == "error" {
+			exitGracefully(withExitCode(exitParse, fmt.Errorf("Key %s appears more than once in column %s", key, fileData.asMap)))
+		}
+		records[key] = record
+	}
+
+	printStatus(fileData, "Writing JSON file...\n")
+	writeString := createStringWriter(getOutputPath(fileData, 0), fileData)
+	write := func(data string, close bool) {
+		report.BytesWritten += int64(len(data))
+		writeString(data, close)
+	}
+	jsonFunc, breakLine := getJSONFunc(fileData, report)
+	colon := ":"
+	if fileData.pretty {
+		colon = ": "
+	}
+	// with no records the object closes straight away as {}, the same way
+	// an empty array closes as [].
+	if len(keys) == 0 {
+		breakLine = ""
+	}
+	write("{"+breakLine, false)
+	for i, key := range keys {
+		if i > 0 {
+			write(","+breakLine, false)
+		}
+		keyData, _ := json.Marshal(key)
+		// pretty records come back already indented, the key goes in front.
+		value := strings.TrimPrefix(jsonFunc(records[key]), fileData.arrayIndent)
+		if fileData.pretty {
+			write(fileData.arrayIndent, false)
+		}
+		write(string(keyData)+colon+value, false)
+		report.RowsWritten++
+	}
+	write(breakLine+"}", true)
+	printStatus(fileData, "Completed!\n")
+	done <- true
+}
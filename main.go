@@ -1,28 +1,209 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
 )
 
 type inputFile struct {
 	// struct to hold cli arguements
-	filepath  string
-	separator string
-	pretty    bool
+	filepath      string
+	separator     string
+	comma         rune
+	outComma      rune
+	headerComma   rune
+	pretty        bool
+	arrayIndent   string
+	objectIndent  string
+	reportPath    string
+	extra         string
+	extraKey      string
+	trimLead      bool
+	rejectBOM     bool
+	quote         byte
+	headerMarker  string
+	section       int
+	tsvUnescape   bool
+	maxOutput     int64
+	pageSize      int
+	chunkArray    int
+	quiet         bool
+	statusOut     bool
+	schema        map[string]string
+	schemaTypes   map[string]schemaCoercer
+	typed         bool
+	boolTrue      []string
+	boolFalse     []string
+	boolFold      bool
+	decimalComma  bool
+	dateLayout    []string
+	floatFmt      string
+	exactNumbers  bool
+	nonFinite     string
+	inferCols     bool
+	appendMode    bool
+	validate      bool
+	output        string
+	asMap         string
+	mapDuplicates string
+	checksum      string
+	sortBy        []sortKey
+	columns       []string
+	errorFile     string
+	requireRecs   bool
+	summary       bool
+	validateOnly  bool
+	compare       string
+	required      []string
+	indexBy       string
+	timeout       time.Duration
+	retries       int
+	compute       []computedField
+	splitFields   map[string]string
+	renames       []headerRename
+	keyCase       string
+	sourceKey     string
+	typeKey       string
+	rowHash       string
+	typeValue     string
+	timestampKey  string
+	convertedAt   string
+	withMeta      bool
+	withWarnings  bool
+	reverse       bool
+	chanBuffer    int
+	// the CSV reader reuses its record slice, always on from the command
+	// line, off only to compare allocations.
+	reuseRecord   bool
+	parallelFiles int
+	preview       int
+	previewFormat string
+	flatten       bool
+	firstColumns  bool
+	keepOrder     bool
+	gzipIn        bool
+	nest          bool
+	nestConflict  string
+	maxRecord     int64
+	maxRows       int
+	headColumns   int
+	format        string
+	separators    []string
+	sepSample     int
+	stringSep     string
+	defaults      map[string]string
+	skipBlank     bool
+	keepEmpty     bool
+	pad           bool
+	nullMissing   bool
+	trim          bool
+	normalize     bool
+	normalizeHead bool
+	blankNull     bool
+	sample        float64
+	seed          int64
+	matchCol      string
+	match         *regexp.Regexp
+}
+
+type skippedRow struct {
+	// a row that was not written along with why it was skipped
+	Line   int    `json:"line"`
+	Reason string `json:"reason"`
+}
+
+type conversionReport struct {
+	// struct to hold the details of a run, written out with -report
+	Input        string       `json:"input"`
+	Columns      []string     `json:"columns"`
+	Separator    string       `json:"separator"`
+	RowsRead     int          `json:"rows_read"`
+	RowsWritten  int          `json:"rows_written"`
+	RowsSkipped  int          `json:"rows_skipped"`
+	RowsFiltered int          `json:"rows_filtered"`
+	BytesWritten int64        `json:"bytes_written"`
+	Skipped      []skippedRow `json:"skipped"`
+	Duration     string       `json:"duration"`
+	// filled in for -summary, which prints it rather than adding it to the
+	// report file.
+	summary []columnSummary
+}
+
+// exit codes so scripts can tell what kind of failure happened.
+const (
+	exitUsage    = 2
+	exitNotFound = 3
+	exitParse    = 4
+	exitWrite    = 5
+)
+
+type exitError struct {
+	// an error tagged with the exit code it should produce
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+func withExitCode(code int, err error) error {
+	// nil stays nil so this can wrap any call result before check.
+	if err == nil {
+		return nil
+	}
+	return &exitError{code, err}
 }
 
 func exitGracefully(err error) {
 	// error handling function to carefully manage user error.
 	fmt.Fprintf(os.Stderr, "error: %v\n", err)
-	os.Exit(1)
+	// anything not tagged with a category is a general failure.
+	code := 1
+	var exitErr *exitError
+	if errors.As(err, &exitErr) {
+		code = exitErr.code
+	}
+	// show how the tool is meant to be called when it was called wrong.
+	if code == exitUsage {
+		flag.Usage()
+	}
+	os.Exit(code)
+}
+
+func printStatus(fileData inputFile, format string, a ...interface{}) {
+	// status messages are for people watching the terminal, -quiet drops them.
+	// They go to stderr so they never mix with data on stdout.
+	if fileData.quiet {
+		return
+	}
+	if fileData.statusOut {
+		fmt.Printf(format, a...)
+		return
+	}
+	fmt.Fprintf(os.Stderr, format, a...)
 }
 
 func check(e error) {
@@ -33,189 +214,2053 @@ func check(e error) {
 }
 
 func getFileData() (inputFile, error) {
-	// Validate arguments have correct length
-	if len(os.Args) < 2 {
-		return inputFile{}, errors.New("A filepath argument is required")
-	}
-	// default seperator is a comma but can take semi colon also from csv.
-	separator := flag.String("separator", "comma", "Column separator")
+	// default seperator is a comma but can take semi colon, tab or any single
+	// character, including escapes such as \t or \x1f.
+	separator := flag.String("separator", "comma", "Column separator: comma, semicolon, tab or a single character")
+	sepSample := flag.Int("separator-sample", 1, "Lines -separators reads to pick a separator, all of them must split into the same number of columns")
+	headerSeparator := flag.String("header-separator", "", "Column separator for the header line when it differs from the data rows, the same names as -separator")
+	outSeparator := flag.String("out-separator", "", "Column separator for the CSV written by -reverse, the same names as -separator, defaults to -separator")
+	separators := flag.String("separators", "", "Comma separated list of separators to try on the header in order, e.g. comma,semicolon,tab")
+	stringSeparator := flag.String("string-separator", "", "Multi-character column separator, escapes such as \\t\\t are allowed")
 	pretty := flag.Bool("pretty", false, "Generate pretty JSON")
+	arrayIndent := flag.Int("array-indent", 2, "Spaces before each record in the array with -pretty")
+	indent := flag.String("indent", "", "Indent both levels with -pretty by this many spaces or by tab, in place of -array-indent and -object-indent")
+	objectIndent := flag.Int("object-indent", 2, "Spaces per nesting level inside each record with -pretty")
+	reverse := flag.Bool("reverse", false, "Convert a JSON array of objects back to CSV")
+	nest := flag.Bool("nest", false, "Turn dotted column names such as address.city into nested objects")
+	nestConflict := flag.String("nest-conflict", "error", "With -nest, what to do when a column is also the parent of another: error or overwrite")
+	flatten := flag.Bool("flatten", false, "With -reverse, write nested objects and arrays as dotted columns such as address.city or tags.0")
+	gzipIn := flag.Bool("gzip-in", false, "With -reverse, read the JSON input as gzip compressed, which is assumed for .gz files")
+	keepOrder := flag.Bool("keep-order", false, "Write each record's keys in the order of the header instead of sorted, -as-map records included")
+	firstColumns := flag.Bool("columns-from-first", false, "With -reverse, take the CSV columns from the first object only, ignoring keys that only later objects have")
+	keyCase := flag.String("key-case", "", "Write the header names as camel (orderId), snake (order_id) or kebab (order-id) case, after -rename-regex")
+	var renameSpecs stringList
+	flag.Var(&renameSpecs, "rename-regex", "Rename every header with a sed style s/pattern/replacement/g, e.g. s/[^A-Za-z0-9]+/_/g, can be repeated")
+	var splitSpecs stringList
+	flag.Var(&splitSpecs, "split-field", "Write a column as a JSON array of its value split on a separator, e.g. tags:|, can be repeated")
+	var computeSpecs stringList
+	flag.Var(&computeSpecs, "compute", "Add a field joined from columns and quoted literals, e.g. fullname=first+' '+last, can be repeated")
+	rowHash := flag.String("row-hash", "", "Add a SHA-1 of each record's columns and values under this key, e.g. __hash")
+	typeField := flag.String("type-field", "", "Add a fixed key and value to every record, e.g. __type=user")
+	timestampKey := flag.String("add-timestamp", "", "Add the time of the conversion in RFC 3339 under this key to every record, or once to _meta with -with-meta, e.g. __converted_at")
+	sourceKey := flag.String("source-key", "", "Add the input file name to every record under this key, e.g. __file")
+	columnsFile := flag.String("columns-file", "", "File listing one output column per line, in the order they are written")
+	sortBy := flag.String("sort-by", "", "Sort records by columns, each optionally :asc or :desc, e.g. lastname:desc,firstname")
+	checksum := flag.String("checksum", "", "Hash each JSON file with sha256 or sha512 and write the sum to a sidecar file")
+	asMap := flag.String("as-map", "", "Write one JSON object keyed by this column instead of an array")
+	mapDuplicates := flag.String("map-duplicates", "error", "With -as-map, what to do with a repeated key: error or last")
+	output := flag.String("output", "", "Write to this path instead of next to the input, - for standard output")
+	validate := flag.Bool("validate", false, "Hold each JSON file in memory and check it is valid before writing it")
+	appendMode := flag.Bool("append", false, "Add the records to the end of an existing JSON array file instead of replacing it")
+	withWarnings := flag.Bool("with-warnings", false, "With -with-meta, add a _warnings block listing the skipped rows and why")
+	withMeta := flag.Bool("with-meta", false, "Wrap the records in an object with a _meta block of the columns and record count")
+	format := flag.String("format", "json", "Output format: json, lines-array (one compact record per line), concat (records back to back with no array), ndjson (one record per line with no array, written to a .ndjson file) or arrays (each record as an array of its values in column order)")
+	quoteEmpty := flag.Bool("quote-empty", false, "With -format arrays, keep empty cells as \"\" even with -blank-as-null, so only missing values are null")
+	indexBy := flag.String("index-by", "", "With -format ndjson, write a .idx file next to each output mapping this column's values to the byte offset of their line")
+	ndjsonNull := flag.Bool("ndjson-empty-null", false, "Write empty cells as null only when -format is ndjson, e.g. to keep one config for both formats")
+	timeout := flag.Duration("timeout", 0, "Time limit for each attempt at fetching a URL input, e.g. 30s")
+	retries := flag.Int("retries", 0, "Times to retry fetching a URL input after a network or server error")
+	summary := flag.Bool("summary", false, "Print a table of each column's non-empty values and likely type to stderr at the end")
+	requireColumns := flag.String("require-columns", "", "Comma separated columns the header must have, the run fails before converting anything otherwise")
+	compare := flag.String("compare", "", "Print the columns added and removed in this other CSV file compared to the input as JSON, without converting")
+	validateOnly := flag.Bool("validate-only", false, "Read and check every row without writing JSON, then print the row counts and the -summary table to stderr")
+	requireRecs := flag.Bool("require-records", false, "Fail when no records are written, e.g. for a header only file")
+	errorFile := flag.String("error-file", "", "Write skipped rows to this CSV file as line_number,reason,raw")
+	reportPath := flag.String("report", "", "Write a JSON report describing the run to this path")
+	extra := flag.String("extra", "error", "What to do with fields beyond the header: truncate, error or collect")
+	extraKey := flag.String("extra-key", "_extra", "Key to store surplus fields under when -extra=collect")
+	tsvUnescape := flag.Bool("tsv-unescape", false, "Turn \\t, \\n, \\r and \\\\ escapes in values into the characters they stand for")
+	section := flag.Int("section", 0, "Only convert the Nth block of lines, counting from 1, where blocks are split by blank lines and each has its own header")
+	headerMarker := flag.String("header-marker", "", "Skip lines until one starting with this text, the rest of that line is the header")
+	quote := flag.String("quote", `"`, "Character fields are quoted with, e.g. ' for single quoted files")
+	rejectBOM := flag.Bool("no-bom-allowed", false, "Fail on a file that starts with a UTF-8 byte order mark instead of dropping it")
+	trimLead := flag.Bool("trim-leading", false, "Ignore leading white space in a field")
+	trim := flag.Bool("trim", false, "Remove white space from both ends of every value")
+	normalize := flag.Bool("normalize-values", false, "Write every value in Unicode NFC form, so a character and its decomposed form are the same text")
+	normalizeHeaders := flag.Bool("normalize-headers", false, "Read the header names in Unicode NFC form, before -rename-regex")
+	maxOutputSize := flag.String("max-output-size", "", "Roll over to a new JSON file once this size is reached, e.g. 100MB")
+	chunkArray := flag.Int("chunk-array", 0, "Write the records as a stream of separate arrays of this many records, one array per line")
+	pageSize := flag.Int("page-size", 0, "Split the output into numbered files of at most this many records")
+	headColumns := flag.Int("head-columns", 0, "Only keep the first N columns, e.g. to look at a very wide file")
+	maxRows := flag.Int("max-rows", 0, "Fail when the input has more than this many data rows, e.g. to guard against a huge file")
+	preview := flag.Int("preview", 0, "Print the first N records as a table instead of writing JSON")
+	previewFormat := flag.String("preview-format", "table", "How -preview prints the records: table, json or pretty, whatever -format and -pretty are")
+	chanBuffer := flag.Int("chan-buffer", 64, "Records the reader can get ahead of the writer by")
+	parallelFiles := flag.Int("parallel-files", 1, "Files of a directory input converted at the same time")
+	quiet := flag.Bool("quiet", false, "Only print errors")
+	statusOut := flag.Bool("status-stdout", false, "Print status messages to stdout instead of stderr")
+	stringColumns := flag.String("string-columns", "", "Comma separated columns that stay strings with -typed or -infer-columns, e.g. zip,phone")
+	schemaFile := flag.String("schema-file", "", "JSON file mapping column names to int, float, bool, string or date")
+	pad := flag.Bool("pad", false, "Fill in missing trailing fields on short rows instead of skipping them")
+	nullMissing := flag.Bool("null-for-missing", false, "With -pad, write the filled in fields as null rather than empty strings")
+	blankNull := flag.Bool("blank-as-null", false, "Write empty cells as null, with -trim a cell of only spaces counts as empty")
+	keepEmpty := flag.Bool("keep-empty", false, "Write each blank line after the header as an empty {} record instead of dropping it, apart from those at the end")
+	skipBlank := flag.Bool("skip-blank", false, "Drop rows where every field is empty, e.g. a line of only separators")
+	defaults := flag.String("defaults", "", "Values for empty cells by column, e.g. status=active,qty=0")
+	sample := flag.Float64("sample", 0, "Only convert a random share of the rows, e.g. 0.1 for about one in ten")
+	seed := flag.Int64("seed", 0, "Seed for -sample so the same rows are picked every run, a new one is used when not given")
+	match := flag.String("match", "", "Only convert rows where a column matches a regex, e.g. email=.*@example\\.com")
+	typed := flag.Bool("typed", false, "Infer numbers and booleans from values instead of writing every value as a string")
+	boolTrue := flag.String("bool-true", "true", "Comma separated values read as true when -typed is set")
+	boolFalse := flag.String("bool-false", "false", "Comma separated values read as false when -typed is set")
+	boolFold := flag.Bool("bool-ignore-case", false, "Match -bool-true and -bool-false values case-insensitively")
+	var dateLayouts stringList
+	flag.Var(&dateLayouts, "date-layout", "Go time layout for dates to write as ISO 8601, e.g. 02/01/2006, can be repeated")
+	inferCols := flag.Bool("infer-columns", false, "Pick one type per column from all of its values, holds every record in memory until the end")
+	nonFinite := flag.String("nonfinite", "null", "What to write for a NaN or infinity in a -schema-file float column: null, string or error")
+	decimalComma := flag.Bool("decimal-comma", false, "Read typed numbers with a decimal comma and dots between thousands, e.g. 1.234,56")
+	exactNumbers := flag.Bool("exact-numbers", false, "Write typed floats with the digits they have in the file, so 5.0 stays 5.0 and 5 stays 5")
+	floatFmt := flag.String("float-fmt", "", "Format for typed floats as %f, %e or %g with optional precision, e.g. %.2f")
+	maxRecordSize := flag.String("max-record-size", "64MB", "Fail when a single record grows past this size, e.g. from an unterminated quote")
+	configPath := flag.String("config", "", "JSON file of default flag values, e.g. {\"separator\":\"semicolon\",\"pretty\":true}")
 	// parse flag arguements
 	flag.Parse()
-	// filepath arguement in position zero.
+	// flags given on the command line win over the environment, which wins
+	// over the config file.
+	if err := applyEnvironment(); err != nil {
+		return inputFile{}, err
+	}
+	if *configPath != "" {
+		if err := applyConfig(*configPath); err != nil {
+			return inputFile{}, err
+		}
+	}
+	// Validate arguments have correct length
+	if flag.NArg() < 1 {
+		return inputFile{}, errors.New("A filepath argument is required")
+	}
+	// filepath arguement in position zero, - reads standard input. There is
+	// no name to give the output then, so it goes to standard output unless
+	// -output names a file.
 	fileLocation := flag.Arg(0)
+	if fileLocation == stdioPath && *output == "" {
+		*output = stdioPath
+	}
+	// each file of a directory gets its own output, report and error file.
+	if isDirectory(fileLocation) && (*output != "" || *reportPath != "" || *errorFile != "") {
+		return inputFile{}, errors.New("A directory input can't be used with -output, -report or -error-file")
+	}
+	// nothing is written, so it's about profiling the file rather than
+	// looking at records.
+	if *validateOnly && (*preview > 0 || *reverse) {
+		return inputFile{}, errors.New("-validate-only can't be used with -preview or -reverse")
+	}
+	var required []string
+	for _, column := range strings.Split(*requireColumns, ",") {
+		if column = strings.TrimSpace(column); column != "" {
+			required = append(required, column)
+		}
+	}
+	if required != nil && *reverse {
+		return inputFile{}, errors.New("-require-columns can't be used with -reverse")
+	}
+	if *compare != "" && (*reverse || isDirectory(fileLocation)) {
+		return inputFile{}, errors.New("-compare can't be used with -reverse or a directory input")
+	}
+	if *sample < 0 || *sample > 1 {
+		return inputFile{}, errors.New("-sample must be between 0 and 1")
+	}
+	// -output is the directory the JSON of an archive goes in.
+	if !*reverse && isZip(fileLocation) && (*output == stdioPath || *reportPath != "" || *errorFile != "") {
+		return inputFile{}, errors.New("A zip archive can't be used with standard output, -report or -error-file")
+	}
+	if *parallelFiles < 1 {
+		return inputFile{}, errors.New("-parallel-files must be at least 1")
+	}
+	// standard output only takes a single stream of data.
+	if *output == stdioPath && (*appendMode || *pageSize > 0 || *maxOutputSize != "" || *checksum != "" || *statusOut) {
+		return inputFile{}, errors.New("Writing to standard output can't be used with -append, -page-size, -max-output-size, -checksum or -status-stdout")
+	}
 
-	// currently only take commas and semi colon.
-	if !(*separator == "comma" || *separator == "semicolon") {
-		return inputFile{}, errors.New("Only comma or semicolon separators are allowed")
+	comma, err := parseSeparator(*separator)
+	if err != nil {
+		return inputFile{}, err
+	}
+	// the header is split like the rows unless -header-separator is given.
+	var headerComma rune
+	if *headerSeparator != "" {
+		if *separators != "" || *stringSeparator != "" {
+			return inputFile{}, errors.New("-header-separator can't be used with -separators or -string-separator")
+		}
+		if headerComma, err = parseSeparator(*headerSeparator); err != nil {
+			return inputFile{}, err
+		}
+	}
+	// the CSV written by -reverse uses -separator unless told otherwise.
+	outComma := comma
+	if *outSeparator != "" {
+		if outComma, err = parseSeparator(*outSeparator); err != nil {
+			return inputFile{}, err
+		}
+	}
+	if *sepSample < 1 {
+		return inputFile{}, errors.New("-separator-sample must be at least 1")
+	}
+	// candidates are checked up front, the choice is made once the header is read.
+	var separatorList []string
+	if *separators != "" {
+		separatorList = strings.Split(*separators, ",")
+		for _, candidate := range separatorList {
+			if _, err := parseSeparator(candidate); err != nil {
+				return inputFile{}, err
+			}
+		}
+	}
+	// surplus fields can be dropped, rejected or kept under their own key.
+	if !(*extra == "truncate" || *extra == "error" || *extra == "collect") {
+		return inputFile{}, errors.New("Only truncate, error or collect are allowed for -extra")
+	}
+	if *nullMissing && !*pad {
+		return inputFile{}, errors.New("-null-for-missing needs -pad")
+	}
+	sortKeys, err := parseSortKeys(*sortBy)
+	if err != nil {
+		return inputFile{}, err
+	}
+	var columns []string
+	if *columnsFile != "" {
+		columns, err = loadColumns(*columnsFile)
+		if err != nil {
+			return inputFile{}, err
+		}
+	}
+	typeKey, typeValue, found := strings.Cut(*typeField, "=")
+	if *typeField != "" && (!found || typeKey == "") {
+		return inputFile{}, fmt.Errorf("-type-field %s must be in the form key=value", *typeField)
+	}
+	if typeKey != "" && typeKey == *sourceKey {
+		return inputFile{}, errors.New("-type-field and -source-key can't use the same key")
+	}
+	if *rowHash != "" && (*rowHash == *sourceKey || *rowHash == typeKey) {
+		return inputFile{}, errors.New("-row-hash can't use the same key as -source-key or -type-field")
+	}
+	if *timestampKey != "" && (*timestampKey == *sourceKey || *timestampKey == typeKey || *timestampKey == *rowHash) {
+		return inputFile{}, errors.New("-add-timestamp can't use the same key as -source-key, -type-field or -row-hash")
+	}
+	if !(*keyCase == "" || *keyCase == "camel" || *keyCase == "snake" || *keyCase == "kebab") {
+		return inputFile{}, errors.New("Only camel, snake or kebab are allowed for -key-case")
+	}
+	if *keyCase != "" && *reverse {
+		return inputFile{}, errors.New("-key-case can't be used with -reverse")
+	}
+	var renames []headerRename
+	for _, spec := range renameSpecs {
+		rename, err := parseRename(spec)
+		if err != nil {
+			return inputFile{}, err
+		}
+		renames = append(renames, rename)
+	}
+	// the column name ends at the first colon, so the separator itself can
+	// be a colon.
+	splitFields := make(map[string]string)
+	for _, spec := range splitSpecs {
+		column, separator, found := strings.Cut(spec, ":")
+		if !found || column == "" || separator == "" {
+			return inputFile{}, fmt.Errorf("-split-field %s must be in the form column:separator", spec)
+		}
+		splitFields[column] = separator
+	}
+	var computed []computedField
+	for _, spec := range computeSpecs {
+		field, err := parseCompute(spec)
+		if err != nil {
+			return inputFile{}, err
+		}
+		computed = append(computed, field)
+	}
+	if _, ok := checksumHashes[*checksum]; *checksum != "" && !ok {
+		return inputFile{}, errors.New("Only sha256 or sha512 are allowed for -checksum")
+	}
+	// an appended file has content that was never written through the hash
+	// or held for checking.
+	if (*checksum != "" || *validate) && *appendMode {
+		return inputFile{}, errors.New("-checksum and -validate can't be used with -append")
+	}
+	if !(*mapDuplicates == "error" || *mapDuplicates == "last") {
+		return inputFile{}, errors.New("Only error or last are allowed for -map-duplicates")
+	}
+	// a keyed object is a single file that isn't an array.
+	if *asMap != "" && (*appendMode || *withMeta || *pageSize > 0 || *maxOutputSize != "" || *format != "json") {
+		return inputFile{}, errors.New("-as-map can't be used with -append, -with-meta, -page-size, -max-output-size or a -format other than json")
+	}
+	// appending only works on a single plain array.
+	if *appendMode && (*withMeta || *pageSize > 0 || *maxOutputSize != "") {
+		return inputFile{}, errors.New("-append can't be used with -with-meta, -page-size or -max-output-size")
+	}
+	if *arrayIndent < 0 || *objectIndent < 0 {
+		return inputFile{}, errors.New("-array-indent and -object-indent can't be negative")
+	}
+	// -indent sets both levels at once, as a number of spaces or as tabs.
+	arrayPrefix, objectPrefix := strings.Repeat(" ", *arrayIndent), strings.Repeat(" ", *objectIndent)
+	if *indent == "tab" {
+		arrayPrefix, objectPrefix = "\t", "\t"
+	} else if *indent != "" {
+		spaces, err := strconv.Atoi(*indent)
+		if err != nil || spaces < 0 {
+			return inputFile{}, fmt.Errorf("-indent %s must be tab or a number of spaces", *indent)
+		}
+		arrayPrefix, objectPrefix = strings.Repeat(" ", spaces), strings.Repeat(" ", spaces)
+	}
+	if *retries < 0 || *timeout < 0 {
+		return inputFile{}, errors.New("-retries and -timeout can't be negative")
+	}
+	if *section < 0 {
+		return inputFile{}, errors.New("-section can't be negative")
+	}
+	if *headColumns < 0 {
+		return inputFile{}, errors.New("-head-columns can't be negative")
+	}
+	if *maxRows < 0 {
+		return inputFile{}, errors.New("-max-rows can't be negative")
+	}
+	if *preview < 0 {
+		return inputFile{}, errors.New("-preview can't be negative")
+	}
+	if !(*previewFormat == "table" || *previewFormat == "json" || *previewFormat == "pretty") {
+		return inputFile{}, errors.New("Only table, json or pretty are allowed for -preview-format")
+	}
+	if *chanBuffer < 0 {
+		return inputFile{}, errors.New("-chan-buffer can't be negative")
+	}
+	if *pageSize < 0 {
+		return inputFile{}, errors.New("-page-size can't be negative")
+	}
+	// no size means a single output file.
+	var maxOutput int64
+	if *maxOutputSize != "" {
+		size, err := parseSize(*maxOutputSize)
+		if err != nil {
+			return inputFile{}, err
+		}
+		maxOutput = size
+	}
+	if !(*format == "json" || *format == "lines-array" || *format == "concat" || *format == "ndjson" || *format == "arrays") {
+		return inputFile{}, errors.New("Only json, lines-array, concat, ndjson or arrays formats are allowed")
+	}
+	// concatenated records have no array to wrap or carry on.
+	// chunks are arrays inside a single file, the other ways of splitting the
+	// output start new files.
+	if *chunkArray < 0 {
+		return inputFile{}, errors.New("-chunk-array can't be negative")
+	}
+	if *chunkArray > 0 && (*pageSize > 0 || *maxOutputSize != "" || *appendMode || *withWarnings || *asMap != "" || *format == "concat" || *format == "ndjson") {
+		return inputFile{}, errors.New("-chunk-array can't be used with -page-size, -max-output-size, -append, -with-warnings, -as-map or -format concat or ndjson")
+	}
+	// the warnings are only all known at the very end of the output.
+	if *withWarnings && (!*withMeta || *pageSize > 0 || *maxOutputSize != "") {
+		return inputFile{}, errors.New("-with-warnings needs -with-meta and can't be used with -page-size or -max-output-size")
+	}
+	// the offsets are only simple for one record per line, and need a file
+	// to point into.
+	if *indexBy != "" && (*format != "ndjson" || *output == stdioPath) {
+		return inputFile{}, errors.New("-index-by needs -format ndjson and can't be used with standard output")
+	}
+	if (*format == "concat" || *format == "ndjson") && (*withMeta || *appendMode) {
+		return inputFile{}, fmt.Errorf("-format %s can't be used with -with-meta or -append", *format)
+	}
+	// a multi-character separator is decoded the same way as -separator.
+	var stringSep string
+	if *stringSeparator != "" {
+		if *separators != "" {
+			return inputFile{}, errors.New("-string-separator can't be used with -separators")
+		}
+		stringSep, err = decodeEscapes(*stringSeparator)
+		if err != nil || stringSep == "" {
+			return inputFile{}, fmt.Errorf("Invalid -string-separator %s", *stringSeparator)
+		}
+		if strings.ContainsAny(stringSep, "\"\r\n") {
+			return inputFile{}, fmt.Errorf("Separator %s can't be used to split columns", *stringSeparator)
+		}
+	}
+	// the quote is swapped byte for byte, so it has to be a single ASCII
+	// character that can't be mistaken for anything else in the file.
+	if len(*quote) != 1 || (*quote)[0] >= utf8.RuneSelf || strings.ContainsAny(*quote, "\r\n") || rune((*quote)[0]) == comma || rune((*quote)[0]) == headerComma || strings.Contains(stringSep, *quote) {
+		return inputFile{}, fmt.Errorf("-quote %s must be a single ASCII character other than the separator", *quote)
+	}
+	defaultValues, err := parseKeyValues(*defaults, "-defaults")
+	if err != nil {
+		return inputFile{}, err
+	}
+	// the column is everything before the first =, the rest is the regex.
+	var matchCol string
+	var matchRegex *regexp.Regexp
+	if *match != "" {
+		column, expression, found := strings.Cut(*match, "=")
+		if !found || column == "" {
+			return inputFile{}, errors.New("-match must be in the form column=regex")
+		}
+		matchRegex, err = regexp.Compile(expression)
+		if err != nil {
+			return inputFile{}, fmt.Errorf("Invalid -match regex %s: %v", expression, err)
+		}
+		matchCol = column
+	}
+	if !(*nestConflict == "error" || *nestConflict == "overwrite") {
+		return inputFile{}, errors.New("Only error or overwrite are allowed for -nest-conflict")
+	}
+	if !(*nonFinite == "null" || *nonFinite == "string" || *nonFinite == "error") {
+		return inputFile{}, errors.New("Only null, string or error are allowed for -nonfinite")
+	}
+	if *exactNumbers && *floatFmt != "" {
+		return inputFile{}, errors.New("-exact-numbers can't be used with -float-fmt")
+	}
+	if *floatFmt != "" && !floatFormat.MatchString(*floatFmt) {
+		return inputFile{}, fmt.Errorf("-float-fmt %s must be %%f, %%e or %%g with an optional precision such as %%.2f", *floatFmt)
+	}
+	maxRecord, err := parseSize(*maxRecordSize)
+	if err != nil {
+		return inputFile{}, err
+	}
+	// typed columns come from the schema file, everything else stays a string.
+	var schema map[string]string
+	if *schemaFile != "" {
+		schema, err = loadSchema(*schemaFile, inputFile{})
+		if err != nil {
+			return inputFile{}, err
+		}
+	}
+	// -string-columns are schema columns of type string, so neither -typed
+	// nor -infer-columns touches them.
+	if *stringColumns != "" {
+		if schema == nil {
+			schema = make(map[string]string)
+		}
+		for _, column := range strings.Split(*stringColumns, ",") {
+			column = strings.TrimSpace(column)
+			if kind, listed := schema[column]; listed && kind != "string" {
+				return inputFile{}, fmt.Errorf("Column %s is in -string-columns but has type %s in the schema file", column, kind)
+			}
+			schema[column] = "string"
+		}
+	}
+	// -ndjson-empty-null and -quote-empty only change the empty cells for
+	// their own format.
+	emptyNull := *blankNull || (*ndjsonNull && *format == "ndjson")
+	if *quoteEmpty && *format == "arrays" {
+		emptyNull = false
 	}
 	// populate struct with values from command line.
-	return inputFile{fileLocation, *separator, *pretty}, nil
+	return inputFile{
+		filepath:      fileLocation,
+		separator:     *separator,
+		comma:         comma,
+		outComma:      outComma,
+		headerComma:   headerComma,
+		pretty:        *pretty,
+		arrayIndent:   arrayPrefix,
+		objectIndent:  objectPrefix,
+		reportPath:    *reportPath,
+		extra:         *extra,
+		extraKey:      *extraKey,
+		trimLead:      *trimLead,
+		rejectBOM:     *rejectBOM,
+		quote:         (*quote)[0],
+		headerMarker:  *headerMarker,
+		section:       *section,
+		tsvUnescape:   *tsvUnescape,
+		maxOutput:     maxOutput,
+		pageSize:      *pageSize,
+		chunkArray:    *chunkArray,
+		quiet:         *quiet,
+		statusOut:     *statusOut,
+		schema:        schema,
+		typed:         *typed,
+		boolTrue:      strings.Split(*boolTrue, ","),
+		boolFalse:     strings.Split(*boolFalse, ","),
+		boolFold:      *boolFold,
+		dateLayout:    dateLayouts,
+		floatFmt:      *floatFmt,
+		exactNumbers:  *exactNumbers,
+		decimalComma:  *decimalComma,
+		nonFinite:     *nonFinite,
+		inferCols:     *inferCols,
+		appendMode:    *appendMode,
+		validate:      *validate,
+		output:        *output,
+		asMap:         *asMap,
+		mapDuplicates: *mapDuplicates,
+		checksum:      *checksum,
+		sortBy:        sortKeys,
+		columns:       columns,
+		errorFile:     *errorFile,
+		requireRecs:   *requireRecs,
+		summary:       *summary || *validateOnly,
+		validateOnly:  *validateOnly,
+		compare:       *compare,
+		required:      required,
+		indexBy:       *indexBy,
+		timeout:       *timeout,
+		retries:       *retries,
+		compute:       computed,
+		splitFields:   splitFields,
+		renames:       renames,
+		keyCase:       *keyCase,
+		sourceKey:     *sourceKey,
+		typeKey:       typeKey,
+		rowHash:       *rowHash,
+		typeValue:     typeValue,
+		timestampKey:  *timestampKey,
+		convertedAt:   time.Now().UTC().Format(time.RFC3339),
+		withMeta:      *withMeta,
+		withWarnings:  *withWarnings,
+		reverse:       *reverse,
+		chanBuffer:    *chanBuffer,
+		reuseRecord:   true,
+		parallelFiles: *parallelFiles,
+		maxRows:       *maxRows,
+		headColumns:   *headColumns,
+		preview:       *preview,
+		previewFormat: *previewFormat,
+		flatten:       *flatten,
+		firstColumns:  *firstColumns,
+		keepOrder:     *keepOrder,
+		gzipIn:        *gzipIn,
+		nest:          *nest,
+		nestConflict:  *nestConflict,
+		maxRecord:     maxRecord,
+		format:        *format,
+		separators:    separatorList,
+		sepSample:     *sepSample,
+		stringSep:     stringSep,
+		defaults:      defaultValues,
+		skipBlank:     *skipBlank,
+		keepEmpty:     *keepEmpty,
+		pad:           *pad,
+		nullMissing:   *nullMissing,
+		trim:          *trim,
+		normalize:     *normalize,
+		normalizeHead: *normalizeHeaders,
+		blankNull:     emptyNull,
+		sample:        *sample,
+		seed:          *seed,
+		matchCol:      matchCol,
+		match:         matchRegex,
+	}, nil
 }
 
-func checkIfValidFile(filename string) (bool, error) {
-	// Check if file is CSV
-	if fileExtension := filepath.Ext(filename); fileExtension != ".csv" {
-		return false, fmt.Errorf("File %s is not CSV", filename)
+type stringList []string
+
+// stringList is a flag that can be given more than once.
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func applyEnvironment() error {
+	// every flag can also come from CSV2JSON_ followed by its name in upper
+	// case with - as _, e.g. CSV2JSON_SEPARATOR. An empty variable is the
+	// same as one that isn't set.
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		name := "CSV2JSON_" + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		value := os.Getenv(name)
+		if value == "" || explicit[f.Name] || err != nil {
+			return
+		}
+		if setErr := flag.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("Environment variable %s: %v", name, setErr)
+		}
+	})
+	return err
+}
+
+func applyConfig(configPath string) error {
+	// each key in the config file is a flag name, its value is used unless
+	// the flag was set on the command line. Lists are for flags that can be
+	// repeated.
+	configData, err := os.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+	config := make(map[string]interface{})
+	decoder := json.NewDecoder(bytes.NewReader(configData))
+	decoder.UseNumber()
+	if err := decoder.Decode(&config); err != nil {
+		return fmt.Errorf("Config file %s is not a JSON object: %v", configPath, err)
+	}
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	for name, value := range config {
+		if flag.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("Config file %s has unknown option %s", configPath, name)
+		}
+		if explicit[name] {
+			continue
+		}
+		values, isList := value.([]interface{})
+		if !isList {
+			values = []interface{}{value}
+		}
+		for _, item := range values {
+			if err := flag.Set(name, fmt.Sprint(item)); err != nil {
+				return fmt.Errorf("Config file %s option %s: %v", configPath, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func loadColumns(columnsPath string) ([]string, error) {
+	// one column name per line, blank lines are ignored.
+	columnsData, err := os.ReadFile(columnsPath)
+	if err != nil {
+		return nil, err
+	}
+	var columns []string
+	for _, line := range strings.Split(string(columnsData), "\n") {
+		if column := strings.TrimSpace(line); column != "" {
+			columns = append(columns, column)
+		}
+	}
+	if columns == nil {
+		return nil, fmt.Errorf("Columns file %s doesn't list any columns", columnsPath)
+	}
+	return columns, nil
+}
+
+func parseKeyValues(list string, flagName string) (map[string]string, error) {
+	// turn "a=1,b=2" into a map, an empty list gives an empty map.
+	values := make(map[string]string)
+	if list == "" {
+		return values, nil
+	}
+	for _, pair := range strings.Split(list, ",") {
+		key, value, found := strings.Cut(pair, "=")
+		if !found || key == "" {
+			return nil, fmt.Errorf("%s entries must be in the form column=value, got %s", flagName, pair)
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+func decodeEscapes(value string) (string, error) {
+	// interpret Go escapes such as \t or \x1f in a command line value.
+	return strconv.Unquote(`"` + value + `"`)
+}
+
+func parseSeparator(separator string) (rune, error) {
+	// named separators first, anything else must decode to one character so
+	// control characters can be given as Go escapes like \t or \x1f.
+	switch separator {
+	case "comma":
+		return ',', nil
+	case "semicolon":
+		return ';', nil
+	case "tab":
+		return '\t', nil
+	}
+	decoded, err := decodeEscapes(separator)
+	if err != nil || utf8.RuneCountInString(decoded) != 1 {
+		return 0, fmt.Errorf("Separator %s must be comma, semicolon, tab or a single character", separator)
+	}
+	comma, _ := utf8.DecodeRuneInString(decoded)
+	if comma == '"' || comma == '\r' || comma == '\n' || comma == utf8.RuneError {
+		return 0, fmt.Errorf("Separator %s can't be used to split columns", separator)
+	}
+	return comma, nil
+}
+
+func parseSize(size string) (int64, error) {
+	// turn a human size such as 512KB or 100MB into bytes.
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"B", 1},
+	}
+	value := strings.ToUpper(strings.TrimSpace(size))
+	multiplier := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSuffix(value, unit.suffix)
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	number, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil || number <= 0 {
+		return 0, fmt.Errorf("Invalid size %s", size)
+	}
+	return number * multiplier, nil
+}
+
+func checkIfValidFile(filename string, extension string) (bool, error) {
+	// a URL may not end in .csv and can only be checked by fetching it,
+	// standard input has no name at all.
+	if isURL(filename) || filename == stdioPath {
+		return true, nil
+	}
+
+	// Check if file is CSV, or JSON in reverse mode
+	if !hasExtension(filename, extension) {
+		return false, withExitCode(exitUsage, fmt.Errorf("File %s is not %s", filename, strings.ToUpper(strings.TrimPrefix(extension, "."))))
 	}
 
 	// Check if file does exist
 	if _, err := os.Stat(filename); err != nil && os.IsNotExist(err) {
-		return false, fmt.Errorf("File %s does not exist", filename)
+		return false, withExitCode(exitNotFound, fmt.Errorf("File %s does not exist", filename))
 	}
 
 	return true, nil
 }
 
-func processLine(headers []string, dataList []string) (map[string]string, error) {
+func processLine(headers []string, dataList []string, fileData inputFile) (map[string]interface{}, error) {
+	// values past the header are handled by the -extra option, short lines
+	// are only valid with -pad.
+	var surplus []string
+	if len(dataList) > len(headers) && fileData.extra != "error" {
+		// copied as the reader reuses the line slice for the next record.
+		surplus = append([]string(nil), dataList[len(headers):]...)
+		dataList = dataList[:len(headers)]
+	}
+	// missing trailing fields are filled in, remembering where the real
+	// values stopped for -null-for-missing.
+	present := len(dataList)
+	if len(dataList) < len(headers) && fileData.pad {
+		dataList = append(append([]string(nil), dataList...), make([]string, len(headers)-len(dataList))...)
+	}
 	// if given line delimiter value length is not the length of inital header
 	if len(dataList) != len(headers) {
 		// throw error as not a valid record.
 		return nil, errors.New("Line doesn't match headers format. Skipping")
 	}
 
-	recordMap := make(map[string]string)
+	recordMap := make(map[string]interface{})
 
 	for i, name := range headers {
-		recordMap[name] = dataList[i]
+		if i >= present && fileData.nullMissing {
+			recordMap[name] = nil
+			continue
+		}
+		cell := dataList[i]
+		if fileData.trim {
+			cell = strings.TrimSpace(cell)
+		}
+		// empty cells take the -defaults value for their column, and are
+		// only null with -blank-as-null when there's no default.
+		if defaultValue, ok := fileData.defaults[name]; ok && cell == "" {
+			cell = defaultValue
+		}
+		if fileData.normalize {
+			cell = norm.NFC.String(cell)
+		}
+		// a -split-field column is an array of strings, empty when the cell
+		// is.
+		if separator, ok := fileData.splitFields[name]; ok {
+			parts := []string{}
+			if cell != "" {
+				parts = strings.Split(cell, separator)
+			}
+			recordMap[name] = parts
+			continue
+		}
+		if cell == "" && fileData.blankNull {
+			recordMap[name] = nil
+			continue
+		}
+		// columns outside the schema are only inferred under -typed,
+		// otherwise the value is kept exactly as it is in the file.
+		var value interface{} = cell
+		if kind, typed := fileData.schema[name]; typed {
+			coerced, err := coerceValue(cell, kind, fileData)
+			if err != nil {
+				return nil, fmt.Errorf("Column %s value %q is not a valid %s. Skipping", name, cell, kind)
+			}
+			value = coerced
+		} else if fileData.typed {
+			value = inferValue(cell, fileData)
+		}
+		formatted, err := formatFloat(value, cell, fileData)
+		if err != nil {
+			return nil, fmt.Errorf("Column %s value %q is %w", name, cell, err)
+		}
+		recordMap[name] = formatted
+	}
+
+	if fileData.extra == "collect" && surplus != nil {
+		if fileData.normalize {
+			for i, value := range surplus {
+				surplus[i] = norm.NFC.String(value)
+			}
+		}
+		recordMap[fileData.extraKey] = surplus
+	}
+
+	for _, field := range fileData.compute {
+		recordMap[field.name] = field.evaluate(recordMap)
+	}
+
+	// only the -columns-file columns are kept.
+	if fileData.columns != nil {
+		selected := make(map[string]interface{}, len(fileData.columns))
+		for _, column := range fileData.columns {
+			selected[column] = recordMap[column]
+		}
+		recordMap = selected
 	}
 
 	return recordMap, nil
 }
 
-func processCsvFile(fileData inputFile, writerChannel chan<- map[string]string) {
-	// get file from OS
-	file, err := os.Open(fileData.filepath)
+type recordLimiter struct {
+	// wraps the input and fails once too much is read without the csv reader
+	// finishing a record, rather than buffering the rest of the file.
+	reader      io.Reader
+	limit       int64
+	read        int64
+	recordStart int64
+}
+
+var errRecordTooLarge = errors.New("record is too large")
+
+func (l *recordLimiter) Read(p []byte) (int, error) {
+	if l.read-l.recordStart > l.limit {
+		return 0, errRecordTooLarge
+	}
+	n, err := l.reader.Read(p)
+	l.read += int64(n)
+	return n, err
+}
+
+func indexOf(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
+
+// stands in for a -string-separator once it has been replaced.
+const unitSeparator = '\x1f'
+
+type separatorReplacer struct {
+	// replaces every separator outside a quoted value as the input is read.
+	// Quotes are followed the way encoding/csv reads them, a doubled quote
+	// inside a quoted value leaves it open. Input that already holds the
+	// unit separator outside quotes will split on it too.
+	reader      io.Reader
+	separator   []byte
+	replacement []byte
+	inQuote     bool
+	pending     []byte
+	carry       []byte
+	err         error
+}
+
+func (r *separatorReplacer) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		buf := make([]byte, 32*1024)
+		n, err := r.reader.Read(buf)
+		r.err = err
+		data := append(r.carry, buf[:n]...)
+		r.carry = nil
+		var out []byte
+		for i := 0; i < len(data); {
+			switch {
+			case data[i] == '"':
+				r.inQuote = !r.inQuote
+			case r.inQuote:
+			case bytes.HasPrefix(data[i:], r.separator):
+				out = append(out, r.replacement...)
+				i += len(r.separator)
+				continue
+			case r.err == nil && bytes.HasPrefix(r.separator, data[i:]):
+				// the start of a separator split across two reads waits for
+				// the rest of it.
+				r.carry = append([]byte(nil), data[i:]...)
+				i = len(data)
+				continue
+			}
+			out = append(out, data[i])
+			i++
+		}
+		r.pending = out
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func contains(values []string, value string) bool {
+	return indexOf(values, value) >= 0
+}
+
+func chooseSeparator(input *bufio.Reader, separators []string, sampleLines int) (string, error) {
+	// the first separator that splits the header into more than one column,
+	// and every other line of the -separator-sample into as many, wins. The
+	// sample is peeked from the buffer and nothing is consumed, so the csv
+	// reader still starts at the top of the file.
+	peeked, _ := input.Peek(input.Size())
+	sample := string(peeked)
+	if len(peeked) == input.Size() {
+		// a full buffer most likely ends part way through a line.
+		sample = sample[:strings.LastIndex(sample, "\n")+1]
+	}
+	for _, separator := range separators {
+		comma, _ := parseSeparator(separator)
+		sampleReader := csv.NewReader(strings.NewReader(sample))
+		sampleReader.Comma = comma
+		sampleReader.LazyQuotes = true
+		sampleReader.FieldsPerRecord = -1
+		// blank lines are skipped and don't count towards the sample.
+		width := 0
+		for read := 0; read < sampleLines; {
+			fields, err := sampleReader.Read()
+			if err != nil {
+				break
+			}
+			if isBlankRecord(fields) {
+				continue
+			}
+			if read == 0 {
+				width = len(fields)
+			} else if len(fields) != width {
+				width = 0
+				break
+			}
+			read++
+		}
+		if width > 1 {
+			return separator, nil
+		}
+	}
+	if sampleLines > 1 {
+		return "", fmt.Errorf("None of the separators %s split the first %d lines into the same number of columns", strings.Join(separators, ","), sampleLines)
+	}
+	return "", fmt.Errorf("None of the separators %s split the header into more than one column", strings.Join(separators, ","))
+}
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+func isBlankRecord(fields []string) bool {
+	// true when every field is empty or only white space.
+	for _, field := range fields {
+		if strings.TrimSpace(field) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+func isEmptyRecord(fields []string) bool {
+	// true when every field is an empty string.
+	for _, field := range fields {
+		if field != "" {
+			return false
+		}
+	}
+	return true
+}
+
+func separatorHint(header string) string {
+	// point at a separator that appears in the header if there is one.
+	for _, candidate := range []struct {
+		name      string
+		separator string
+	}{
+		{"semicolon", ";"},
+		{"tab", "\t"},
+		{"comma", ","},
+		{"|", "|"},
+	} {
+		if strings.Contains(header, candidate.separator) {
+			return fmt.Sprintf("the file may use a different separator, try -separator %s", candidate.name)
+		}
+	}
+	return "check -separator matches the file"
+}
+
+// the escapes TSV dialects use for characters that can't appear in a field.
+var tsvReplacer = strings.NewReplacer(`\\`, `\`, `\t`, "\t", `\n`, "\n", `\r`, "\r")
+
+func rawLine(file io.ReaderAt, start int64, end int64, line []string, comma rune, fileData inputFile) string {
+	// read the row back from the file as it was written. A -string-separator
+	// changes the offsets and a download can't be read back, so then the row
+	// is rebuilt from its fields.
+	if fileData.stringSep != "" {
+		return strings.Join(line, fileData.stringSep)
+	}
+	if file == nil {
+		return strings.Join(line, string(comma))
+	}
+	raw := make([]byte, end-start)
+	if _, err := file.ReadAt(raw, start); err != nil && err != io.EOF {
+		return strings.Join(line, string(comma))
+	}
+	return strings.Trim(string(raw), "\r\n")
+}
+
+func recordSizeError(err error, line int, limit int64) error {
+	// a record this big is almost always a quote that was never closed.
+	if errors.Is(err, errRecordTooLarge) {
+		return fmt.Errorf("Record starting around line %d is larger than %d bytes, possible unterminated quote", line, limit)
+	}
+	return err
+}
+
+// csvSource is a csv reader positioned after the header, and how much of the
+// input was skipped before the reader started.
+type csvSource struct {
+	reader        *csv.Reader
+	limiter       *recordLimiter
+	skippedLength int64
+	skippedLines  int
+	// the line the header ends on, as the csv reader counts them.
+	headerEnd int
+}
+
+func recordEndLine(reader *csv.Reader, fields []string) int {
+	// the line the record just read ends on, a quoted value can run over
+	// several.
+	line, _ := reader.FieldPos(len(fields) - 1)
+	return line + strings.Count(fields[len(fields)-1], "\n")
+}
+
+func readCSVHeader(file io.Reader, fileData inputFile, report *conversionReport) (csvSource, []string) {
+	// read data to reader, dropping a UTF-8 byte order mark if there is one.
+	input := bufio.NewReaderSize(file, 64*1024)
+	var skippedLength int64
+	if start, _ := input.Peek(len(utf8BOM)); bytes.Equal(start, utf8BOM) {
+		if fileData.rejectBOM {
+			exitGracefully(withExitCode(exitParse, fmt.Errorf("File %s starts with a UTF-8 byte order mark", fileData.filepath)))
+		}
+		input.Discard(len(utf8BOM))
+		skippedLength = int64(len(utf8BOM))
+	}
+	// with -section only one block of lines is read. With -header-marker
+	// everything up to the marker is skipped and the rest of its line is the
+	// header. The csv reader only sees what follows, so its offsets and line
+	// numbers are shifted back by what was skipped.
+	skippedLines := 0
+	if fileData.section > 0 {
+		sectionInput, skippedBytes, lines, err := skipToSection(input, fileData.section)
+		check(withExitCode(exitParse, err))
+		input = sectionInput
+		skippedLength += skippedBytes
+		skippedLines += lines
+	}
+	if fileData.headerMarker != "" {
+		for {
+			text, err := input.ReadString('\n')
+			if strings.HasPrefix(text, fileData.headerMarker) {
+				rest := strings.TrimLeft(text[len(fileData.headerMarker):], " ")
+				skippedLength += int64(len(text) - len(rest))
+				input = bufio.NewReaderSize(io.MultiReader(strings.NewReader(rest), input), 64*1024)
+				break
+			}
+			if err == io.EOF {
+				exitGracefully(withExitCode(exitParse, fmt.Errorf("Header marker %s not found", fileData.headerMarker)))
+			}
+			check(withExitCode(exitParse, err))
+			skippedLength += int64(len(text))
+			skippedLines++
+		}
+	}
+	comma := fileData.comma
+	if fileData.separators != nil {
+		separator, err := chooseSeparator(input, fileData.separators, fileData.sepSample)
+		check(withExitCode(exitParse, err))
+		comma, _ = parseSeparator(separator)
+		report.Separator = separator
+	}
+	var source io.Reader = input
+	if fileData.quote != '"' {
+		source = &quoteSwapper{reader: source, quote: fileData.quote}
+	}
+	if fileData.stringSep != "" {
+		// the csv reader only splits on one character, so the multi-character
+		// separator is swapped for the unit separator before parsing, quoted
+		// values keep theirs.
+		source = &separatorReplacer{reader: source, separator: []byte(fileData.stringSep), replacement: []byte{unitSeparator}}
+		comma = unitSeparator
+		report.Separator = fileData.stringSep
+	}
+	limiter := &recordLimiter{reader: source, limit: fileData.maxRecord}
+	reader := csv.NewReader(limiter)
+	// let processLine decide what to do with rows that don't match the headers
+	// rather than the reader failing the whole file.
+	reader.FieldsPerRecord = -1
+	// from struct, read separator and assign to reader.
+	reader.Comma = comma
+	// spaces straight after the delimiter are dropped, e.g. " a, b, c".
+	reader.TrimLeadingSpace = fileData.trimLead
+	// the line slice is reused between reads to save allocations, anything
+	// kept past the next read has to be copied out of it.
+	reader.ReuseRecord = fileData.reuseRecord
+	// read values from reader, throw error if there otherwise nil.
+	// this reads the first line in reader, following lines are
+	// assumed to be values.
+	// lines with nothing but white space before the header are skipped, a
+	// file with only those (or only a BOM) has no header at all. The header
+	// can have its own -header-separator, the reader switches back to the
+	// data separator after it.
+	if fileData.headerComma != 0 {
+		reader.Comma = fileData.headerComma
+	}
+	var headers []string
+	var headerEnd int
+	for {
+		var err error
+		headers, err = reader.Read()
+		if err == io.EOF {
+			exitGracefully(withExitCode(exitParse, errors.New("No usable header row found")))
+		}
+		check(withExitCode(exitParse, recordSizeError(err, skippedLines+1, fileData.maxRecord)))
+		if !isBlankRecord(headers) {
+			headerEnd = recordEndLine(reader, headers)
+			headers = append([]string(nil), headers...)
+			break
+		}
+	}
+	reader.Comma = comma
+	if fileData.quote != '"' {
+		swapQuotes(headers, fileData.quote)
+	}
+	// -normalize-headers, -rename-regex and then -key-case run before
+	// anything looks at the names, so every other option uses the new ones.
+	if fileData.normalizeHead {
+		check(withExitCode(exitParse, normalizeHeaders(headers)))
+	}
+	if fileData.renames != nil {
+		check(withExitCode(exitParse, renameHeaders(headers, fileData.renames)))
+	}
+	if fileData.keyCase != "" {
+		check(withExitCode(exitParse, caseHeaders(headers, fileData.keyCase)))
+	}
+	// -head-columns keeps the leftmost columns and drops every field after
+	// them, including any past the end of the header.
+	if fileData.headColumns > 0 && len(headers) > fileData.headColumns {
+		headers = headers[:fileData.headColumns]
+	}
+	return csvSource{reader, limiter, skippedLength, skippedLines, headerEnd}, headers
+}
+
+func processCsvFile(fileData inputFile, writerChannel chan<- map[string]interface{}, headerChecked chan<- bool, report *conversionReport) {
+	// get file from OS, or from the web for a URL
+	file, fileAt, err := openInput(fileData)
 	// Check for error
 	check(err)
 	// close the file now we have data in memory
 	defer file.Close()
 	// Get Headers
-	var headers, line []string
-	// read data to reader
-	reader := csv.NewReader(file)
-	// from struct, read separator and assign to reader.
-	// default is comma, no need to explictly define.
-	if fileData.separator == "semicolon" {
-		reader.Comma = ';'
+	var line []string
+	source, headers := readCSVHeader(file, fileData, report)
+	reader, limiter := source.reader, source.limiter
+	skippedLength, skippedLines := source.skippedLength, source.skippedLines
+	limiter.recordStart = reader.InputOffset()
+	lastLine, _ := reader.FieldPos(0)
+	lastLine += skippedLines
+	widestLine := 0
+	var buffered []map[string]interface{}
+	// values are kept as strings on the first pass and typed once all of
+	// them have been read.
+	if fileData.inferCols {
+		fileData.typed = false
 	}
-	// read values from reader, throw error if there otherwise nil.
-	// this reads the first line in reader, following lines are
-	// assumed to be values.
-	headers, err = reader.Read()
-	check(err)
+	// set before any record is sent so the writer can use it.
+	report.Columns = headers
+	if fileData.summary {
+		report.summary = make([]columnSummary, len(headers))
+		for i, name := range headers {
+			report.summary[i].name = name
+		}
+	}
+	// -require-columns names every missing column at once.
+	var missing []string
+	for _, column := range fileData.required {
+		if !contains(headers, column) {
+			missing = append(missing, column)
+		}
+	}
+	if missing != nil {
+		exitGracefully(withExitCode(exitParse, fmt.Errorf("Required columns missing from the header: %s", strings.Join(missing, ", "))))
+	}
+	// every column in the schema must be in the file.
+	for column := range fileData.schema {
+		if !contains(headers, column) {
+			exitGracefully(withExitCode(exitParse, fmt.Errorf("Schema column %s is not in the header", column)))
+		}
+	}
+	for column := range fileData.defaults {
+		if !contains(headers, column) {
+			exitGracefully(withExitCode(exitParse, fmt.Errorf("Default column %s is not in the header", column)))
+		}
+	}
+	for column := range fileData.splitFields {
+		if !contains(headers, column) {
+			exitGracefully(withExitCode(exitParse, fmt.Errorf("Split column %s is not in the header", column)))
+		}
+	}
+	for _, field := range fileData.compute {
+		check(withExitCode(exitParse, field.checkColumns(headers)))
+	}
+	if fileData.sourceKey != "" && contains(headers, fileData.sourceKey) {
+		exitGracefully(withExitCode(exitParse, fmt.Errorf("Source key %s is already a column in the header", fileData.sourceKey)))
+	}
+	if fileData.rowHash != "" && contains(headers, fileData.rowHash) {
+		exitGracefully(withExitCode(exitParse, fmt.Errorf("Row hash key %s is already a column in the header", fileData.rowHash)))
+	}
+	if fileData.typeKey != "" && contains(headers, fileData.typeKey) {
+		exitGracefully(withExitCode(exitParse, fmt.Errorf("Type field %s is already a column in the header", fileData.typeKey)))
+	}
+	if fileData.timestampKey != "" && contains(headers, fileData.timestampKey) {
+		exitGracefully(withExitCode(exitParse, fmt.Errorf("Timestamp key %s is already a column in the header", fileData.timestampKey)))
+	}
+	sourceName := inputBaseName(fileData.filepath)
+	for _, column := range fileData.columns {
+		if !contains(headers, column) && !isComputed(fileData.compute, column) {
+			exitGracefully(withExitCode(exitParse, fmt.Errorf("Listed column %s is not in the header", column)))
+		}
+	}
+	if fileData.asMap != "" && !contains(headers, fileData.asMap) && !isComputed(fileData.compute, fileData.asMap) {
+		exitGracefully(withExitCode(exitParse, fmt.Errorf("Map key column %s is not in the header", fileData.asMap)))
+	}
+	if fileData.indexBy != "" && !contains(headers, fileData.indexBy) && !isComputed(fileData.compute, fileData.indexBy) {
+		exitGracefully(withExitCode(exitParse, fmt.Errorf("Index column %s is not in the header", fileData.indexBy)))
+	}
+	for _, key := range fileData.sortBy {
+		if !contains(headers, key.column) && !isComputed(fileData.compute, key.column) {
+			exitGracefully(withExitCode(exitParse, fmt.Errorf("Sort column %s is not in the header", key.column)))
+		}
+	}
+	// the keys records are written with, -columns-file ones or the header
+	// and -compute fields, are enough to find a -nest conflict.
+	if fileData.nest && fileData.nestConflict == "error" {
+		columns := fileData.columns
+		if columns == nil {
+			columns = append([]string(nil), headers...)
+			for _, field := range fileData.compute {
+				columns = append(columns, field.name)
+			}
+		}
+		check(withExitCode(exitParse, nestConflict(columns)))
+	}
+	// rows are filtered on the raw value of the -match column.
+	matchIndex := -1
+	if fileData.match != nil {
+		matchIndex = indexOf(headers, fileData.matchCol)
+		if matchIndex < 0 {
+			exitGracefully(withExitCode(exitParse, fmt.Errorf("Match column %s is not in the header", fileData.matchCol)))
+		}
+	}
+	// -sample keeps each row with the same chance, a fixed -seed picks the
+	// same rows of the same file every time.
+	seed := fileData.seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	sampler := rand.New(rand.NewSource(seed))
+	// skipped rows are written to -error-file with the line as it was in
+	// the input.
+	var errorWriter *csv.Writer
+	if fileData.errorFile != "" {
+		errorOutput, err := os.Create(fileData.errorFile)
+		check(withExitCode(exitWrite, writeFailure(fileData.errorFile, err)))
+		defer errorOutput.Close()
+		errorWriter = csv.NewWriter(errorOutput)
+		check(withExitCode(exitWrite, errorWriter.Write([]string{"line_number", "reason", "raw"})))
+	}
+	close(headerChecked)
+	// each row read is handled here, empty rows at the end of the file are
+	// held back first and never get this far.
+	handleRow := func(line []string, lineNumber int, lineStart int64, lineEnd int64) {
+		report.RowsRead++
+		if fileData.maxRows > 0 && report.RowsRead > fileData.maxRows {
+			exitGracefully(withExitCode(exitParse, fmt.Errorf("Input has more than %d data rows, stopped at line %d", fileData.maxRows, lineNumber)))
+		}
+		if fileData.headColumns > 0 && len(line) > fileData.headColumns {
+			line = line[:fileData.headColumns]
+		}
+		if fileData.quote != '"' {
+			swapQuotes(line, fileData.quote)
+		}
+		if fileData.tsvUnescape {
+			for i, field := range line {
+				line[i] = tsvReplacer.Replace(field)
+			}
+		}
+		for i := range report.summary {
+			if i < len(line) {
+				report.summary[i].add(line[i], fileData)
+			}
+		}
+		// a blank line only gets here with -keep-empty, it has nothing to
+		// match against the header and is written as an empty record.
+		if len(line) == 0 {
+			if fileData.inferCols {
+				buffered = append(buffered, map[string]interface{}{})
+			} else {
+				writerChannel <- map[string]interface{}{}
+			}
+			return
+		}
+		if fileData.skipBlank && isEmptyRecord(line) {
+			report.RowsFiltered++
+			return
+		}
+		// a cell -pad fills in is matched as empty, a short row without -pad
+		// goes on to be skipped as not matching the header.
+		if matchIndex >= 0 && (matchIndex < len(line) || fileData.pad) {
+			matchValue := ""
+			if matchIndex < len(line) {
+				matchValue = line[matchIndex]
+			}
+			if !fileData.match.MatchString(matchValue) {
+				report.RowsFiltered++
+				return
+			}
+		}
+		if fileData.sample > 0 && sampler.Float64() >= fileData.sample {
+			report.RowsFiltered++
+			return
+		}
+		record, err := processLine(headers, line, fileData)
+		if errors.Is(err, errNonFinite) {
+			// -nonfinite error stops the whole run rather than skipping.
+			exitGracefully(withExitCode(exitParse, fmt.Errorf("Line %d: %v", lineNumber, err)))
+		}
+
+		if err != nil {
+			// an error isn't a status message, -quiet and -status-stdout
+			// leave it on stderr.
+			fmt.Fprintf(os.Stderr, "Line: %sError: %s\n", line, err)
+			// keep track of the skipped row for the report.
+			report.RowsSkipped++
+			report.Skipped = append(report.Skipped, skippedRow{lineNumber, err.Error()})
+			if errorWriter != nil {
+				raw := rawLine(fileAt, skippedLength+lineStart, skippedLength+lineEnd, line, reader.Comma, fileData)
+				check(withExitCode(exitWrite, errorWriter.Write([]string{strconv.Itoa(lineNumber), err.Error(), raw})))
+			}
+			return
+		}
+
+		if fileData.rowHash != "" {
+			record[fileData.rowHash] = recordHash(record)
+		}
+		if fileData.sourceKey != "" {
+			record[fileData.sourceKey] = sourceName
+		}
+		if fileData.typeKey != "" {
+			record[fileData.typeKey] = fileData.typeValue
+		}
+		// under -with-meta the timestamp is written once in _meta instead.
+		if fileData.timestampKey != "" && !fileData.withMeta {
+			record[fileData.timestampKey] = fileData.convertedAt
+		}
+		if fileData.inferCols {
+			buffered = append(buffered, record)
+			return
+		}
+		writerChannel <- record
+	}
+	type heldRow struct {
+		line       []string
+		lineNumber int
+		start, end int64
+	}
+	var held []heldRow
+	// the csv reader skips blank lines, they only show up as a gap between
+	// the line one record ends on and the line the next starts on.
+	lastEnd := source.headerEnd
 	// for each line in reader, process check the line is valid and add to record map
 	for {
 		line, err = reader.Read()
 		// if end of CSV close writer and exit function.
 		if err == io.EOF {
+			report.RowsRead += len(held)
+			report.RowsFiltered += len(held)
+			// one column everywhere is usually the wrong separator, but a file
+			// can also really have one column so this only warns.
+			if len(headers) == 1 && widestLine <= 1 {
+				printStatus(fileData, "Warning: every row has a single column, %s\n", separatorHint(headers[0]))
+			}
+			// with -infer-columns nothing is sent until every value of every
+			// column has been seen.
+			if fileData.inferCols {
+				kinds := inferColumnKinds(headers, buffered, fileData)
+				for _, record := range buffered {
+					typedRecord, err := applyColumnKinds(record, kinds, fileData)
+					check(withExitCode(exitParse, err))
+					writerChannel <- typedRecord
+				}
+			}
+			if errorWriter != nil {
+				errorWriter.Flush()
+				check(withExitCode(exitWrite, errorWriter.Error()))
+			}
 			close(writerChannel)
 			break
 		} else if err != nil {
 			// if error is not null then call exit func.
-			exitGracefully(err)
+			exitGracefully(withExitCode(exitParse, recordSizeError(err, lastLine+1, fileData.maxRecord)))
+		}
+		lineStart := limiter.recordStart
+		limiter.recordStart = reader.InputOffset()
+		lastLine, _ = reader.FieldPos(0)
+		// -keep-empty writes each blank line as a record of its own, they are
+		// held like rows of empty fields so blank lines at the end of the
+		// file are still dropped.
+		if fileData.keepEmpty {
+			for blank := lastEnd + 1; blank < lastLine; blank++ {
+				held = append(held, heldRow{nil, blank + skippedLines, lineStart, lineStart})
+			}
+		}
+		lastEnd = recordEndLine(reader, line)
+		lastLine += skippedLines
+		if len(line) > widestLine {
+			widestLine = len(line)
 		}
 
-		record, err := processLine(headers, line)
-
-		if err != nil {
-			fmt.Printf("Line: %sError: %s\n", line, err)
+		// a row of only empty fields waits until a row with data follows it,
+		// so separators on the last lines don't turn into blank records.
+		if len(line) > 0 && isEmptyRecord(line) {
+			held = append(held, heldRow{append([]string(nil), line...), lastLine, lineStart, limiter.recordStart})
 			continue
 		}
+		for _, row := range held {
+			handleRow(row.line, row.lineNumber, row.start, row.end)
+		}
+		held = nil
+		handleRow(line, lastLine, lineStart, limiter.recordStart)
+	}
+}
 
-		writerChannel <- record
+func outputExtension(fileData inputFile) string {
+	if fileData.format == "ndjson" {
+		return ".ndjson"
 	}
+	return ".json"
 }
 
-func createStringWriter(csvPath string) func(string, bool) {
-	// get path from inital CSV
-	jsonDir := filepath.Dir(csvPath)
-	//
-	jsonName := fmt.Sprintf("%s.json", strings.TrimSuffix(filepath.Base(csvPath), ".csv"))
-	finalLocation := fmt.Sprintf("%s/%s", jsonDir, jsonName)
+func getOutputPath(fileData inputFile, part int) string {
+	// get path from inital CSV, or from -output when it is given.
+	jsonDir := inputDir(fileData.filepath)
+	baseName := trimExtension(safeFileName(inputBaseName(fileData.filepath)), ".csv")
+	extension := outputExtension(fileData)
+	if fileData.output == stdioPath {
+		return stdioPath
+	}
+	// -output is used exactly as it is given for a single file, numbered
+	// parts keep its extension whatever it is.
+	if fileData.output != "" {
+		if fileData.pageSize == 0 && part == 0 {
+			return fileData.output
+		}
+		jsonDir = filepath.Dir(fileData.output)
+		extension = filepath.Ext(fileData.output)
+		baseName = strings.TrimSuffix(filepath.Base(fileData.output), extension)
+	}
+	// pages are always numbered, otherwise the first part keeps the plain
+	// name and later parts are numbered.
+	jsonName := baseName + extension
+	if fileData.pageSize > 0 {
+		jsonName = fmt.Sprintf("%s.%03d%s", baseName, part, extension)
+	} else if part > 0 {
+		jsonName = fmt.Sprintf("%s.%d%s", baseName, part, extension)
+	}
+	return filepath.Join(jsonDir, jsonName)
+}
+
+func writeFailure(path string, err error) error {
+	// a permission problem gets a plain message rather than the raw OS error.
+	if errors.Is(err, os.ErrPermission) {
+		return fmt.Errorf("Cannot write output file %s: permission denied", path)
+	}
+	return err
+}
 
+func createOutput(finalLocation string, fileData inputFile) (io.WriteCloser, error) {
+	if finalLocation == stdioPath {
+		return nopWriteCloser{os.Stdout}, nil
+	}
 	f, err := os.Create(finalLocation)
-	check(err)
+	if err != nil {
+		return nil, writeFailure(finalLocation, err)
+	}
+	return withChecksum(f, finalLocation, fileData), nil
+}
+
+func createStringWriter(finalLocation string, fileData inputFile) func(string, bool) {
+	// with -validate the file is only created once its JSON checks out.
+	if fileData.validate {
+		return streamStringWriter(&validatingWriter{path: finalLocation, fileData: fileData})
+	}
+	f, err := createOutput(finalLocation, fileData)
+	check(withExitCode(exitWrite, err))
 
+	return streamStringWriter(f)
+}
+
+func lastNonSpace(f *os.File, end int64) (int64, byte, error) {
+	// walk back from end to the last byte that isn't JSON white space.
+	buf := make([]byte, 1)
+	for pos := end - 1; pos >= 0; pos-- {
+		if _, err := f.ReadAt(buf, pos); err != nil {
+			return 0, 0, err
+		}
+		if !strings.ContainsRune(" \t\r\n", rune(buf[0])) {
+			return pos, buf[0], nil
+		}
+	}
+	return -1, 0, nil
+}
+
+func openAppendWriter(finalLocation string) (func(string, bool), bool) {
+	// open an existing JSON array and cut it back to just before its closing
+	// bracket so new records can follow. Returns a nil writer when there is
+	// no file yet, and whether the array already has records in it.
+	f, err := os.OpenFile(finalLocation, os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, false
+	}
+	check(withExitCode(exitWrite, writeFailure(finalLocation, err)))
+
+	info, err := f.Stat()
+	check(withExitCode(exitWrite, err))
+	if !info.Mode().IsRegular() {
+		// pipes and devices can't be read back or cut short, so the records
+		// just go out as a fresh array.
+		f.Close()
+		return nil, false
+	}
+	closing, last, err := lastNonSpace(f, info.Size())
+	check(withExitCode(exitWrite, err))
+	if last != ']' {
+		exitGracefully(withExitCode(exitWrite, fmt.Errorf("File %s doesn't end with a JSON array, can't append", finalLocation)))
+	}
+	end, last, err := lastNonSpace(f, closing)
+	check(withExitCode(exitWrite, err))
+	if end < 0 {
+		exitGracefully(withExitCode(exitWrite, fmt.Errorf("File %s doesn't end with a JSON array, can't append", finalLocation)))
+	}
+	check(withExitCode(exitWrite, f.Truncate(end+1)))
+	_, err = f.Seek(end+1, io.SeekStart)
+	check(withExitCode(exitWrite, err))
+
+	return streamStringWriter(f), last != '['
+}
+
+func streamStringWriter(w io.WriteCloser) func(string, bool) {
+	// only writes in order, so any sink will do: a file, a pipe or an upload
+	// stream. Seeking is left to openAppendWriter.
 	return func(data string, close bool) {
-		_, err := f.WriteString(data)
-		check(err)
+		_, err := io.WriteString(w, data)
+		check(withExitCode(exitWrite, err))
 
 		if close {
-			f.Close()
+			check(withExitCode(exitWrite, w.Close()))
 		}
 	}
 }
 
-func getJSONFunc(pretty bool) (func(map[string]string) string, string) {
-	var jsonFunc func(map[string]string) string
+func marshalOrdered(record map[string]interface{}, keys []string) ([]byte, error) {
+	// json.Marshal sorts map keys, this writes them in the given order instead
+	// followed by any keys that weren't given, sorted.
+	var rest []string
+	for key := range record {
+		if !contains(keys, key) {
+			rest = append(rest, key)
+		}
+	}
+	sort.Strings(rest)
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range append(append([]string{}, keys...), rest...) {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		keyData, _ := json.Marshal(key)
+		valueData, err := json.Marshal(record[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(keyData)
+		buf.WriteByte(':')
+		buf.Write(valueData)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func marshalArray(record map[string]interface{}, keys []string) ([]byte, error) {
+	// the values go in the given key order, null where the record doesn't
+	// have the key, then the values of any keys that weren't given in sorted
+	// key order, the same order marshalOrdered uses.
+	var rest []string
+	for key := range record {
+		if !contains(keys, key) {
+			rest = append(rest, key)
+		}
+	}
+	sort.Strings(rest)
+	values := make([]interface{}, 0, len(keys)+len(rest))
+	for _, key := range append(append([]string{}, keys...), rest...) {
+		values = append(values, record[key])
+	}
+	return json.Marshal(values)
+}
+
+func getJSONFunc(fileData inputFile, report *conversionReport) (func(map[string]interface{}) string, string) {
+	var jsonFunc func(map[string]interface{}) string
 	var breakLine string
-	if pretty {
+	// keys are sorted unless a -columns-file gives their order, or
+	// -keep-order asks for the header's.
+	marshal := func(record map[string]interface{}) []byte {
+		jsonData, _ := json.Marshal(record)
+		return jsonData
+	}
+	if fileData.columns != nil {
+		keys := fileData.columns
+		if fileData.nest {
+			keys = topLevelKeys(keys)
+		}
+		marshal = func(record map[string]interface{}) []byte {
+			jsonData, _ := marshalOrdered(record, keys)
+			return jsonData
+		}
+	} else if fileData.keepOrder {
+		// the header is only known once the first record has been sent.
+		marshal = func(record map[string]interface{}) []byte {
+			keys := report.Columns
+			if fileData.nest {
+				keys = topLevelKeys(keys)
+			}
+			jsonData, _ := marshalOrdered(record, keys)
+			return jsonData
+		}
+	}
+	if fileData.format == "arrays" {
+		// the header is read before the first record is sent, so it can be
+		// looked up here.
+		marshal = func(record map[string]interface{}) []byte {
+			keys := fileData.columns
+			if keys == nil {
+				keys = report.Columns
+			}
+			if fileData.nest {
+				keys = topLevelKeys(keys)
+			}
+			jsonData, _ := marshalArray(record, keys)
+			return jsonData
+		}
+	}
+	if fileData.nest {
+		flat := marshal
+		marshal = func(record map[string]interface{}) []byte {
+			nested, err := nestRecord(record, fileData)
+			check(withExitCode(exitParse, err))
+			return flat(nested)
+		}
+	}
+	if fileData.format == "lines-array" || fileData.format == "ndjson" {
+		// compact records, each on its own line inside the array or on their
+		// own for ndjson.
+		breakLine = "\n"
+		jsonFunc = func(record map[string]interface{}) string {
+			return string(marshal(record))
+		}
+	} else if fileData.pretty {
 		breakLine = "\n"
-		jsonFunc = func(record map[string]string) string {
-			jsonData, _ := json.MarshalIndent(record, "   ", "   ")
-			return "   " + string(jsonData)
+		// each record starts at the array indent and its fields go one
+		// object indent further per level. Under -with-meta the array is
+		// itself inside an object, so everything sits one level deeper.
+		recordIndent := fileData.arrayIndent
+		if fileData.withMeta {
+			recordIndent = fileData.objectIndent + fileData.arrayIndent
+		} else if fileData.format == "concat" {
+			recordIndent = ""
+		}
+		jsonFunc = func(record map[string]interface{}) string {
+			var jsonData bytes.Buffer
+			json.Indent(&jsonData, marshal(record), recordIndent, fileData.objectIndent)
+			return recordIndent + jsonData.String()
 		}
 	} else {
 		breakLine = ""
-		jsonFunc = func(record map[string]string) string {
-			jsonData, _ := json.Marshal(record)
-			return string(jsonData)
+		jsonFunc = func(record map[string]interface{}) string {
+			return string(marshal(record))
 		}
 	}
 
 	return jsonFunc, breakLine
 }
 
-func writeJSONFile(csvPath string, writerChannel <-chan map[string]string, done chan<- bool, pretty bool) {
-	writeString := createStringWriter(csvPath)
-	jsonFunc, breakLine := getJSONFunc(pretty)
+func writeJSONFile(fileData inputFile, writerChannel <-chan map[string]interface{}, done chan<- bool, report *conversionReport) {
+	part := 0
+	var written int64
+	// with -append an existing array is carried on rather than replaced.
+	var partWriter func(string, bool)
+	hasRecords := false
+	if fileData.appendMode {
+		partWriter, hasRecords = openAppendWriter(getOutputPath(fileData, part))
+	}
+	appending := partWriter != nil
+	if !appending {
+		partWriter = createStringWriter(getOutputPath(fileData, part), fileData)
+	}
+	// keep a count of the bytes in the current part for -max-output-size.
+	writeString := func(data string, close bool) {
+		written += int64(len(data))
+		report.BytesWritten += int64(len(data))
+		partWriter(data, close)
+	}
+	jsonFunc, breakLine := getJSONFunc(fileData, report)
+	// pretty output is laid out the way json.Indent would lay out the whole
+	// file.
+	pretty := fileData.pretty && fileData.format != "lines-array"
+	// with -with-meta each file is an object holding the records array and a
+	// _meta block, which goes last as the count is only known at the end.
+	// Each record is written with the line break in front of it, so an empty
+	// array closes straight away as [].
+	arrayStart := "["
+	if fileData.withMeta && pretty {
+		arrayStart = "{\n" + fileData.objectIndent + `"records": [`
+	} else if fileData.withMeta {
+		arrayStart = "{" + breakLine + `"records":[`
+	}
+	arrayEnd := func(count int) string {
+		closing := breakLine + "]"
+		if fileData.withMeta && pretty {
+			closing = "\n" + fileData.objectIndent + "]"
+		}
+		if count == 0 && !hasRecords {
+			closing = "]"
+		}
+		if !fileData.withMeta {
+			return closing
+		}
+		// -with-warnings adds the skipped rows after _meta. It only ever goes
+		// in a single file, which ends once every row has been read.
+		keys := []string{"_meta"}
+		meta := map[string]interface{}{"columns": report.Columns, "count": count}
+		if fileData.timestampKey != "" {
+			meta[fileData.timestampKey] = fileData.convertedAt
+		}
+		blocks := []interface{}{meta}
+		if fileData.withWarnings {
+			warnings := report.Skipped
+			if warnings == nil {
+				warnings = []skippedRow{}
+			}
+			keys = append(keys, "_warnings")
+			blocks = append(blocks, warnings)
+		}
+		end := closing
+		for i, key := range keys {
+			data, _ := json.Marshal(blocks[i])
+			if pretty {
+				var indented bytes.Buffer
+				json.Indent(&indented, data, fileData.objectIndent, fileData.objectIndent)
+				end += ",\n" + fileData.objectIndent + `"` + key + `": ` + indented.String()
+			} else {
+				end += "," + breakLine + `"` + key + `":` + string(data)
+			}
+		}
+		return end + breakLine + "}"
+	}
+	firstSep, recordSep := breakLine, ","+breakLine
+	if fileData.format == "concat" {
+		// each record is a top level value of its own, -pretty puts them on
+		// separate lines.
+		arrayStart = ""
+		arrayEnd = func(int) string { return "" }
+		firstSep, recordSep = "", breakLine
+	} else if fileData.format == "ndjson" {
+		// every record line ends in a line break, including the last.
+		arrayStart = ""
+		arrayEnd = func(count int) string {
+			if count == 0 {
+				return ""
+			}
+			return "\n"
+		}
+		firstSep, recordSep = "", "\n"
+	}
+
+	// -index-by notes where each record line starts in the current file.
+	index := &recordIndex{column: fileData.indexBy}
+	writeIndex := func() {
+		if fileData.indexBy != "" {
+			check(withExitCode(exitWrite, index.write(getOutputPath(fileData, part))))
+		}
+	}
 
-	fmt.Println("Writing JSON file...")
+	printStatus(fileData, "Writing JSON file...\n")
 
-	writeString("["+breakLine, false)
 	first := true
+	if !appending {
+		writeString(arrayStart, false)
+	} else if hasRecords {
+		first = false
+	}
+	partRecords := 0
 	for {
 		record, more := <-writerChannel
 		if more {
+			jsonData := jsonFunc(record)
+			// close this part and start the next one if the record would take
+			// it past the size limit or the page is full, every part is a
+			// complete array.
+			overSize := fileData.maxOutput > 0 &&
+				written+int64(len(recordSep+jsonData+arrayEnd(partRecords+1))) > fileData.maxOutput
+			pageFull := fileData.pageSize > 0 && partRecords >= fileData.pageSize
+			if !first && (overSize || pageFull) {
+				writeString(arrayEnd(partRecords), true)
+				writeIndex()
+				part++
+				partWriter = createStringWriter(getOutputPath(fileData, part), fileData)
+				written = 0
+				partRecords = 0
+				writeString(arrayStart, false)
+				first = true
+			}
+			// -chunk-array closes the array and opens the next one on a new
+			// line of the same output.
+			if !first && fileData.chunkArray > 0 && partRecords >= fileData.chunkArray {
+				writeString(arrayEnd(partRecords)+"\n"+arrayStart, false)
+				partRecords = 0
+				first = true
+			}
+
 			if !first {
-				writeString(","+breakLine, false)
+				writeString(recordSep, false)
 			} else {
+				writeString(firstSep, false)
 				first = false
 			}
 
-			jsonData := jsonFunc(record)
+			if fileData.indexBy != "" {
+				check(withExitCode(exitParse, index.add(record, written)))
+			}
 			writeString(jsonData, false)
+			partRecords++
+			report.RowsWritten++
 		} else {
-			writeString(breakLine+"]", true)
-			fmt.Println("Completed!")
+			writeString(arrayEnd(partRecords), true)
+			writeIndex()
+			printStatus(fileData, "Completed!\n")
 			done <- true
 			break
 		}
 	}
 }
 
+func previewRecords(fileData inputFile, writerChannel <-chan map[string]interface{}, out io.Writer, report *conversionReport) error {
+	// collect the first -preview records and print them as an aligned table
+	// with the header columns first and any added keys after them.
+	var records []map[string]interface{}
+	for record := range writerChannel {
+		records = append(records, record)
+		if len(records) == fileData.preview {
+			break
+		}
+	}
+	if fileData.previewFormat != "table" {
+		return previewJSON(fileData, records, out, report)
+	}
+	columns := append([]string{}, report.Columns...)
+	var added []string
+	for _, record := range records {
+		for key := range record {
+			if !contains(columns, key) && !contains(added, key) {
+				added = append(added, key)
+			}
+		}
+	}
+	sort.Strings(added)
+	columns = append(columns, added...)
+
+	table := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, strings.Join(columns, "\t"))
+	for _, record := range records {
+		values := make([]string, len(columns))
+		for i, column := range columns {
+			values[i] = csvValue(record[column])
+		}
+		fmt.Fprintln(table, strings.Join(values, "\t"))
+	}
+	return table.Flush()
+}
+
+func previewJSON(fileData inputFile, records []map[string]interface{}, out io.Writer, report *conversionReport) error {
+	// the preview is a plain array laid out by -preview-format alone, the
+	// output options only apply to the file that isn't written.
+	shown := fileData
+	shown.format = "json"
+	shown.withMeta = false
+	shown.pretty = fileData.previewFormat == "pretty"
+	jsonFunc, breakLine := getJSONFunc(shown, report)
+	var preview strings.Builder
+	preview.WriteString("[")
+	for i, record := range records {
+		if i > 0 {
+			preview.WriteString(",")
+		}
+		preview.WriteString(breakLine + jsonFunc(record))
+	}
+	if len(records) > 0 {
+		preview.WriteString(breakLine)
+	}
+	preview.WriteString("]\n")
+	_, err := io.WriteString(out, preview.String())
+	return err
+}
+
+func writeReport(reportPath string, report *conversionReport) error {
+	// write the run report as indented JSON, separate from the data output.
+	if report.Skipped == nil {
+		report.Skipped = []skippedRow{}
+	}
+	reportData, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFailure(reportPath, os.WriteFile(reportPath, append(reportData, '\n'), 0644))
+}
+
+func finishRun(fileData inputFile, report *conversionReport, start time.Time) {
+	// write the report, then fail if -require-records wanted output and
+	// there wasn't any.
+	if fileData.reportPath != "" {
+		report.Duration = time.Since(start).String()
+		check(withExitCode(exitWrite, writeReport(fileData.reportPath, report)))
+	}
+	if fileData.validateOnly {
+		fmt.Fprintf(os.Stderr, "%d rows read, %d valid, %d skipped, %d filtered\n", report.RowsRead, report.RowsWritten, report.RowsSkipped, report.RowsFiltered)
+	}
+	if fileData.summary && report.summary != nil {
+		check(printSummary(os.Stderr, report.summary, report.RowsRead))
+	}
+	if fileData.requireRecs && report.RowsWritten == 0 {
+		exitGracefully(errors.New("No records were written"))
+	}
+}
+
 func main() {
 	flag.Usage = func() {
-		fmt.Printf("Usage: %s [options] <csvFile>\nOptions:\n", os.Args[0])
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage: %s [options] <csvFile>\n       %s -reverse [options] <jsonFile>\nOptions:\n", os.Args[0], os.Args[0])
 		flag.PrintDefaults()
+		fmt.Fprintf(out, "Examples:\n")
+		fmt.Fprintf(out, "  %s data.csv\n", os.Args[0])
+		fmt.Fprintf(out, "  %s -separator semicolon -pretty data.csv\n", os.Args[0])
+		fmt.Fprintf(out, "  %s -separator tab -report report.json data.csv\n", os.Args[0])
+		fmt.Fprintf(out, "  %s -reverse -flatten data.json\n", os.Args[0])
+		fmt.Fprintf(out, "  cat data.csv | %s - > data.json\n", os.Args[0])
+		fmt.Fprintf(out, "  %s -parallel-files 4 exports/\n", os.Args[0])
 	}
 
 	fileData, err := getFileData()
 
 	if err != nil {
-		exitGracefully(err)
+		// a missing schema file is a missing input, anything else is how the
+		// tool was called.
+		if errors.Is(err, os.ErrNotExist) {
+			exitGracefully(withExitCode(exitNotFound, err))
+		}
+		exitGracefully(withExitCode(exitUsage, err))
 	}
 
-	if _, err := checkIfValidFile(fileData.filepath); err != nil {
+	extension := ".csv"
+	if fileData.reverse {
+		extension = ".json"
+		// data.json.gz only has .gz as its extension.
+		if hasExtension(fileData.filepath, ".gz") {
+			extension = ".gz"
+		}
+	}
+	if isDirectory(fileData.filepath) {
+		check(convertDirectory(fileData, extension))
+		return
+	}
+	if !fileData.reverse && isZip(fileData.filepath) {
+		if _, err := checkIfValidFile(fileData.filepath, ".zip"); err != nil {
+			exitGracefully(err)
+		}
+		check(convertZip(fileData))
+		return
+	}
+	if _, err := checkIfValidFile(fileData.filepath, extension); err != nil {
 		exitGracefully(err)
 	}
 
-	writerChannel := make(chan map[string]string)
+	// -compare only reads the two headers.
+	if fileData.compare != "" {
+		if _, err := checkIfValidFile(fileData.compare, ".csv"); err != nil {
+			exitGracefully(err)
+		}
+		check(compareHeaders(fileData, os.Stdout))
+		return
+	}
+
+	start := time.Now()
+	report := &conversionReport{Input: fileData.filepath, Separator: fileData.separator}
+
+	if fileData.reverse {
+		check(writeCsvFile(fileData, report))
+		finishRun(fileData, report, start)
+		return
+	}
+
+	// a buffered channel lets reading carry on while the writer is busy.
+	writerChannel := make(chan map[string]interface{}, fileData.chanBuffer)
 	done := make(chan bool)
 
-	go processCsvFile(fileData, writerChannel)
-	go writeJSONFile(fileData.filepath, writerChannel, done, fileData.pretty)
+	// the writer only starts once the header has been checked, so a header
+	// that fails doesn't leave an empty output file behind.
+	headerChecked := make(chan bool)
+	go processCsvFile(fileData, writerChannel, headerChecked, report)
+	<-headerChecked
+
+	// sorting sits between the reader and the writer.
+	var records <-chan map[string]interface{} = writerChannel
+	if fileData.sortBy != nil {
+		sorted := make(chan map[string]interface{}, fileData.chanBuffer)
+		go sortRecords(fileData.sortBy, writerChannel, sorted)
+		records = sorted
+	}
+
+	// a preview only shows the first records, nothing is written.
+	if fileData.preview > 0 {
+		check(previewRecords(fileData, records, os.Stdout, report))
+		return
+	}
+
+	// -validate-only counts the records that would have been written.
+	if fileData.validateOnly {
+		for range records {
+			report.RowsWritten++
+		}
+		finishRun(fileData, report, start)
+		return
+	}
+
+	if fileData.asMap != "" {
+		go writeJSONMap(fileData, records, done, report)
+	} else {
+		go writeJSONFile(fileData, records, done, report)
+	}
 
 	<-done
+
+	finishRun(fileData, report, start)
 }
@@ -0,0 +1,2345 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// the tests run the tool as a child process the way a user would, so exit
+// codes and what goes to stdout and stderr can be checked. The test binary
+// runs main instead of the tests when this variable is set.
+const runMainEnv = "GO_CSV_TO_JSON_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) != "" {
+		// main registers its own flags, the test flags are left out. Like
+		// the real command line, -h prints whatever flag.Usage is.
+		flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+		flag.CommandLine.Usage = func() { flag.Usage() }
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+type runResult struct {
+	stdout string
+	stderr string
+	code   int
+}
+
+func runToolEnv(t *testing.T, env []string, stdin string, args ...string) runResult {
+	// CSV2JSON_ variables of whoever runs the tests are dropped so they
+	// can't change the defaults, env adds the ones a test wants.
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	for _, variable := range os.Environ() {
+		if !strings.HasPrefix(variable, "CSV2JSON_") {
+			cmd.Env = append(cmd.Env, variable)
+		}
+	}
+	cmd.Env = append(append(cmd.Env, runMainEnv+"=1"), env...)
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	code := 0
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		code = exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return runResult{stdout.String(), stderr.String(), code}
+}
+
+func runTool(t *testing.T, args ...string) runResult {
+	t.Helper()
+	return runToolEnv(t, nil, "", args...)
+}
+
+func convert(t *testing.T, args ...string) runResult {
+	// a run that has to succeed.
+	t.Helper()
+	result := runTool(t, args...)
+	if result.code != 0 {
+		t.Fatalf("%v exited with %d: %s", args, result.code, result.stderr)
+	}
+	return result
+}
+
+func writeFile(t *testing.T, dir string, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func decodeJSON(t *testing.T, data string, value interface{}) {
+	// numbers are kept as written so 5 and 5.0 can be told apart.
+	t.Helper()
+	decoder := json.NewDecoder(strings.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(value); err != nil {
+		t.Fatalf("not valid JSON: %v\n%s", err, data)
+	}
+}
+
+func readRecords(t *testing.T, path string) []map[string]interface{} {
+	t.Helper()
+	var records []map[string]interface{}
+	decodeJSON(t, readFile(t, path), &records)
+	return records
+}
+
+func TestReport(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "id,name\n1,a\n2\n3,c\n")
+	reportPath := filepath.Join(dir, "report.json")
+	convert(t, "-quiet", "-report", reportPath, input)
+
+	var report struct {
+		Input        string   `json:"input"`
+		Columns      []string `json:"columns"`
+		Separator    string   `json:"separator"`
+		RowsRead     int      `json:"rows_read"`
+		RowsWritten  int      `json:"rows_written"`
+		RowsSkipped  int      `json:"rows_skipped"`
+		RowsFiltered int      `json:"rows_filtered"`
+		BytesWritten int64    `json:"bytes_written"`
+		Skipped      []struct {
+			Line   int    `json:"line"`
+			Reason string `json:"reason"`
+		} `json:"skipped"`
+		Duration string `json:"duration"`
+	}
+	decodeJSON(t, readFile(t, reportPath), &report)
+	if report.Input != input || report.Separator != "comma" || strings.Join(report.Columns, ",") != "id,name" {
+		t.Errorf("report describes the wrong input: %+v", report)
+	}
+	if report.RowsRead != 3 || report.RowsWritten != 2 || report.RowsSkipped != 1 || report.RowsFiltered != 0 {
+		t.Errorf("report has the wrong row counts: %+v", report)
+	}
+	if len(report.Skipped) != 1 || report.Skipped[0].Line != 3 {
+		t.Errorf("report should list line 3 as skipped: %+v", report.Skipped)
+	}
+	output := readFile(t, filepath.Join(dir, "data.json"))
+	if report.BytesWritten != int64(len(output)) {
+		t.Errorf("report has %d bytes written, the output has %d", report.BytesWritten, len(output))
+	}
+	if report.Duration == "" {
+		t.Error("report has no duration")
+	}
+}
+
+func TestQuiet(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "id,name\n1,a\n2\n")
+
+	result := convert(t, input)
+	if !strings.Contains(result.stderr, "Completed!") {
+		t.Errorf("status missing without -quiet: %q", result.stderr)
+	}
+	// -quiet drops the status messages but the skipped row is still
+	// reported.
+	result = convert(t, "-quiet", input)
+	if strings.Contains(result.stderr, "Writing JSON") || strings.Contains(result.stderr, "Completed!") {
+		t.Errorf("status printed under -quiet: %q", result.stderr)
+	}
+	if !strings.Contains(result.stderr, "Line: [2]Error: Line doesn't match headers format") {
+		t.Errorf("row error not printed under -quiet: %q", result.stderr)
+	}
+	// with -status-stdout the status moves to stdout, the error doesn't.
+	result = convert(t, "-status-stdout", input)
+	if strings.Contains(result.stdout, "Error") || !strings.Contains(result.stderr, "Error") {
+		t.Errorf("row error went to stdout with -status-stdout: stdout %q, stderr %q", result.stdout, result.stderr)
+	}
+}
+
+func TestBoolVocabulary(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "active\nyes\nY\nno\nmaybe\n")
+	convert(t, "-quiet", "-typed", "-bool-true", "yes,y", "-bool-false", "no", "-bool-ignore-case", input)
+	got := readFile(t, filepath.Join(dir, "data.json"))
+	want := `[{"active":true},{"active":true},{"active":false},{"active":"maybe"}]`
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	// without -bool-ignore-case only the exact tokens match.
+	convert(t, "-quiet", "-typed", "-bool-true", "yes,y", "-bool-false", "no", input)
+	got = readFile(t, filepath.Join(dir, "data.json"))
+	want = `[{"active":true},{"active":"Y"},{"active":false},{"active":"maybe"}]`
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestTypedOnlyInfersJSONNumbers(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "name\nNan\ninf\nInfinity\n1_0\n0x1p2\n+5\n.5\n007\n42\n-1.5e3\n")
+	convert(t, "-quiet", "-typed", input)
+	got := readFile(t, filepath.Join(dir, "data.json"))
+	want := `[{"name":"Nan"},{"name":"inf"},{"name":"Infinity"},{"name":"1_0"},{"name":"0x1p2"},{"name":"+5"},{"name":".5"},{"name":"007"},{"name":42},{"name":-1500}]`
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	// -infer-columns keeps a column with any of them as strings.
+	input = writeFile(t, dir, "mixed.csv", "name,n\nNan,1\ninf,2.5\n")
+	convert(t, "-quiet", "-infer-columns", input)
+	got = readFile(t, filepath.Join(dir, "mixed.json"))
+	want = `[{"n":1,"name":"Nan"},{"n":2.5,"name":"inf"}]`
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestStringSeparator(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "id\t\tnote\n1\t\t\"x\t\ty\"\n2\t\tz\n")
+	convert(t, "-quiet", "-string-separator", `\t\t`, input)
+	got := readFile(t, filepath.Join(dir, "data.json"))
+	want := `[{"id":"1","note":"x\t\ty"},{"id":"2","note":"z"}]`
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestSeparatorReplacerSplitReads(t *testing.T) {
+	// a separator split across reads is still found, one inside quotes is
+	// left alone.
+	input := `a<>b<>"c<>""d"<>e<`
+	replacer := &separatorReplacer{reader: iotest.OneByteReader(strings.NewReader(input)), separator: []byte("<>"), replacement: []byte{unitSeparator}}
+	got, err := io.ReadAll(replacer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "a\x1fb\x1f\"c<>\"\"d\"\x1fe<"
+	if string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestFlattenRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	original := `[{"id":1,"ok":true,"address":{"city":"Oslo","zip":"0150"},"tags":["a","b","c","d","e","f","g","h","i","j","k"],"meta":{},"list":[]}]`
+	input := writeFile(t, dir, "data.json", original)
+	convert(t, "-quiet", "-reverse", "-flatten", input)
+	csvData := readFile(t, filepath.Join(dir, "data.csv"))
+	header := strings.SplitN(csvData, "\n", 2)[0]
+	wantHeader := "address.city,address.zip,id,list,meta,ok,tags.0,tags.1,tags.2,tags.3,tags.4,tags.5,tags.6,tags.7,tags.8,tags.9,tags.10"
+	if header != wantHeader {
+		t.Errorf("got header %s, want %s", header, wantHeader)
+	}
+
+	back := filepath.Join(dir, "back.json")
+	convert(t, "-quiet", "-nest", "-typed", "-output", back, filepath.Join(dir, "data.csv"))
+	var want, got interface{}
+	decodeJSON(t, original, &want)
+	decodeJSON(t, readFile(t, back), &got)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("round trip changed the records\ngot  %s\nwant %s", readFile(t, back), original)
+	}
+}
+
+func TestNullForMissing(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "a,b,c\n1,,\n2\n")
+	convert(t, "-quiet", "-pad", "-null-for-missing", input)
+	got := readFile(t, filepath.Join(dir, "data.json"))
+	want := `[{"a":"1","b":"","c":""},{"a":"2","b":null,"c":null}]`
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestMatchPaddedCell(t *testing.T) {
+	// the cell -pad fills in is empty, so it doesn't match ^x.
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "n,email\n1\n2,xy\n3,\n")
+	convert(t, "-quiet", "-pad", "-match", "email=^x", input)
+	got := readFile(t, filepath.Join(dir, "data.json"))
+	want := `[{"email":"xy","n":"2"}]`
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	// and it matches a pattern that takes an empty value.
+	convert(t, "-quiet", "-pad", "-match", "email=^$", input)
+	got = readFile(t, filepath.Join(dir, "data.json"))
+	want = `[{"email":"","n":"1"},{"email":"","n":"3"}]`
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestURLRetry(t *testing.T) {
+	// the first request fails with a server error, the retry gets the file.
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "id\n1\n")
+	}))
+	defer server.Close()
+	output := filepath.Join(t.TempDir(), "out.json")
+
+	result := runTool(t, "-quiet", "-output", output, server.URL+"/data.csv")
+	if result.code != exitNotFound || !strings.Contains(result.stderr, "503") {
+		t.Fatalf("got exit %d without -retries, want %d: %s", result.code, exitNotFound, result.stderr)
+	}
+	atomic.StoreInt32(&requests, 0)
+	convert(t, "-quiet", "-retries", "1", "-output", output, server.URL+"/data.csv")
+	if got := readFile(t, output); got != `[{"id":"1"}]` {
+		t.Errorf("got %s", got)
+	}
+	if got := atomic.LoadInt32(&requests); got != 2 {
+		t.Errorf("got %d requests, want 2", got)
+	}
+}
+
+func TestURLTimeout(t *testing.T) {
+	// a client error isn't retried, a request past -timeout is.
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.URL.Path == "/missing.csv" {
+			http.NotFound(w, r)
+			return
+		}
+		select {
+		case <-time.After(2 * time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+
+	_, err := fetchURL(inputFile{filepath: server.URL + "/missing.csv", retries: 2})
+	if got := atomic.LoadInt32(&requests); err == nil || got != 1 {
+		t.Errorf("a 404 was retried or didn't fail: %v after %d requests", err, got)
+	}
+	atomic.StoreInt32(&requests, 0)
+	start := time.Now()
+	_, err = fetchURL(inputFile{filepath: server.URL + "/slow.csv", retries: 1, timeout: 50 * time.Millisecond})
+	if err == nil || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want a deadline error", err)
+	}
+	if got := atomic.LoadInt32(&requests); got != 2 {
+		t.Errorf("got %d requests, want 2", got)
+	}
+	if elapsed := time.Since(start); elapsed > 1500*time.Millisecond {
+		t.Errorf("timed out requests took %s", elapsed)
+	}
+}
+
+func TestKeepEmpty(t *testing.T) {
+	// blank lines are dropped, with -keep-empty the ones before the last
+	// row are written as {}. A blank line inside a quoted value is part of
+	// the value.
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "id,note\n1,\"x\n\ny\"\n\n\n2,b\n\n")
+	convert(t, "-quiet", input)
+	got := readFile(t, filepath.Join(dir, "data.json"))
+	want := `[{"id":"1","note":"x\n\ny"},{"id":"2","note":"b"}]`
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	convert(t, "-quiet", "-keep-empty", input)
+	got = readFile(t, filepath.Join(dir, "data.json"))
+	want = `[{"id":"1","note":"x\n\ny"},{},{},{"id":"2","note":"b"}]`
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestAsMap(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "id,name\n1,a\n2,b\n1,c\n")
+	result := runTool(t, "-quiet", "-as-map", "id", input)
+	if result.code != exitParse || !strings.Contains(result.stderr, "Key 1 appears more than once in column id") {
+		t.Errorf("got exit %d for a repeated key: %s", result.code, result.stderr)
+	}
+	// the last record wins and keeps the place of the first.
+	convert(t, "-quiet", "-as-map", "id", "-map-duplicates", "last", input)
+	got := readFile(t, filepath.Join(dir, "data.json"))
+	want := `{"1":{"id":"1","name":"c"},"2":{"id":"2","name":"b"}}`
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	// a header only file is an empty object, pretty or not.
+	input = writeFile(t, dir, "empty.csv", "id,name\n")
+	for _, pretty := range []string{"-pretty=false", "-pretty"} {
+		convert(t, "-quiet", "-as-map", "id", pretty, input)
+		if got := readFile(t, filepath.Join(dir, "empty.json")); got != "{}" {
+			t.Errorf("got %q with %s, want {}", got, pretty)
+		}
+	}
+}
+
+func TestStdinOutput(t *testing.T) {
+	dir := t.TempDir()
+	// standard input goes to standard output unless -output names a file.
+	result := runToolEnv(t, nil, "id\n1\n", "-quiet", "-")
+	if result.code != 0 || result.stdout != `[{"id":"1"}]` {
+		t.Errorf("got exit %d and %q on stdout", result.code, result.stdout)
+	}
+	output := filepath.Join(dir, "named.json")
+	result = runToolEnv(t, nil, "id\n1\n", "-quiet", "-output", output, "-")
+	if result.code != 0 || result.stdout != "" {
+		t.Errorf("got exit %d and %q on stdout", result.code, result.stdout)
+	}
+	if got := readFile(t, output); got != `[{"id":"1"}]` {
+		t.Errorf("got %s in %s", got, output)
+	}
+}
+
+func TestOutputPathAsGiven(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "id\n1\n2\n3\n")
+	for _, name := range []string{"out.txt", "out", "out.json"} {
+		output := filepath.Join(dir, name)
+		convert(t, "-quiet", "-output", output, input)
+		if got := readFile(t, output); got != `[{"id":"1"},{"id":"2"},{"id":"3"}]` {
+			t.Errorf("got %s in %s", got, output)
+		}
+	}
+	output := filepath.Join(dir, "lines.json")
+	convert(t, "-quiet", "-format", "ndjson", "-output", output, input)
+	if got := readFile(t, output); got != "{\"id\":\"1\"}\n{\"id\":\"2\"}\n{\"id\":\"3\"}\n" {
+		t.Errorf("got %q in %s", got, output)
+	}
+	// pages are numbered from the -output name.
+	convert(t, "-quiet", "-page-size", "2", "-output", filepath.Join(dir, "page.txt"), input)
+	for _, name := range []string{"page.000.txt", "page.001.txt"} {
+		readFile(t, filepath.Join(dir, name))
+	}
+}
+
+func TestParallelFiles(t *testing.T) {
+	// every file of the directory is converted, a bad one doesn't stop the
+	// others and fails the run.
+	dir := t.TempDir()
+	for _, name := range []string{"a.csv", "b.csv", "c.csv", "d.csv"} {
+		writeFile(t, dir, name, "id\n"+name+"\n")
+	}
+	writeFile(t, dir, "notes.txt", "not csv")
+	convert(t, "-quiet", "-parallel-files", "3", dir)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		if got := readFile(t, filepath.Join(dir, name+".json")); got != `[{"id":"`+name+`.csv"}]` {
+			t.Errorf("got %s for %s", got, name)
+		}
+	}
+	bad := writeFile(t, dir, "e.csv", "name\nx\n")
+	os.Remove(filepath.Join(dir, "a.json"))
+	result := runTool(t, "-quiet", "-parallel-files", "2", "-require-columns", "id", dir)
+	if result.code == 0 || !strings.Contains(result.stderr, "1 of 5 files failed: "+bad) {
+		t.Errorf("got exit %d: %s", result.code, result.stderr)
+	}
+	readFile(t, filepath.Join(dir, "a.json"))
+}
+
+func TestZipWithDoubleDash(t *testing.T) {
+	dir := t.TempDir()
+	var archive bytes.Buffer
+	writer := zip.NewWriter(&archive)
+	for name, content := range map[string]string{"a.csv": "id\n1\n", "sub/b.csv": "id\n2\n", "readme.txt": "x"} {
+		entry, err := writer.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(entry, content)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	input := writeFile(t, dir, "-data.zip", archive.String())
+	// the path after -- can start with -, the flags of each entry still go
+	// before it.
+	convert(t, "-quiet", "--", input)
+	if got := readFile(t, filepath.Join(dir, "-data", "a.json")); got != `[{"id":"1"}]` {
+		t.Errorf("got %s for a.csv", got)
+	}
+	if got := readFile(t, filepath.Join(dir, "-data", "sub", "b.json")); got != `[{"id":"2"}]` {
+		t.Errorf("got %s for sub/b.csv", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "-data", "readme.json")); err == nil {
+		t.Error("readme.txt was converted")
+	}
+}
+
+func TestNormalizeValues(t *testing.T) {
+	// the same é, decomposed and composed.
+	decomposed, composed := "cafe\u0301", "caf\u00e9"
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", decomposed+",b\n"+decomposed+","+composed+"\n")
+	convert(t, "-quiet", "-normalize-values", "-normalize-headers", input)
+	records := readRecords(t, filepath.Join(dir, "data.json"))
+	if len(records) != 1 || records[0][composed] != composed || records[0]["b"] != composed {
+		t.Errorf("got %v, want every value and the header as %q", records, composed)
+	}
+	// without the flags the header and value keep their bytes.
+	convert(t, "-quiet", input)
+	records = readRecords(t, filepath.Join(dir, "data.json"))
+	if len(records) != 1 || records[0][decomposed] != decomposed {
+		t.Errorf("got %v, want %q left as it is", records, decomposed)
+	}
+	input = writeFile(t, dir, "same.csv", decomposed+","+composed+"\n1,2\n")
+	result := runTool(t, "-quiet", "-normalize-headers", input)
+	if result.code != exitParse || !strings.Contains(result.stderr, "are the same after -normalize-headers") {
+		t.Errorf("got exit %d: %s", result.code, result.stderr)
+	}
+}
+
+func TestExtraFields(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "a,b\n1,2,3,4\n5,6\n")
+	for _, test := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-extra", "truncate"}, `[{"a":"1","b":"2"},{"a":"5","b":"6"}]`},
+		{[]string{"-extra", "error"}, `[{"a":"5","b":"6"}]`},
+		{[]string{"-extra", "collect"}, `[{"_extra":["3","4"],"a":"1","b":"2"},{"a":"5","b":"6"}]`},
+		{[]string{"-extra", "collect", "-extra-key", "rest"}, `[{"a":"1","b":"2","rest":["3","4"]},{"a":"5","b":"6"}]`},
+	} {
+		convert(t, append(append([]string{"-quiet"}, test.args...), input)...)
+		if got := readFile(t, filepath.Join(dir, "data.json")); got != test.want {
+			t.Errorf("%v: got %s, want %s", test.args, got, test.want)
+		}
+	}
+	if result := runTool(t, "-extra", "keep", input); result.code != exitUsage {
+		t.Errorf("got exit %d for an unknown -extra", result.code)
+	}
+}
+
+func TestTrimLeading(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "a, b, c\n1, 2,  3 \n")
+	convert(t, "-quiet", input)
+	got := readFile(t, filepath.Join(dir, "data.json"))
+	if want := `[{" b":" 2"," c":"  3 ","a":"1"}]`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	// only the space after each separator goes, not the space at the end.
+	convert(t, "-quiet", "-trim-leading", input)
+	got = readFile(t, filepath.Join(dir, "data.json"))
+	if want := `[{"a":"1","b":"2","c":"3 "}]`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestMaxOutputSize(t *testing.T) {
+	dir := t.TempDir()
+	var rows strings.Builder
+	rows.WriteString("id\n")
+	for i := 0; i < 10; i++ {
+		fmt.Fprintf(&rows, "%d\n", i)
+	}
+	input := writeFile(t, dir, "data.csv", rows.String())
+	convert(t, "-quiet", "-max-output-size", "40B", input)
+	// every part is a complete array no bigger than the limit, and together
+	// they hold every record in order.
+	var ids []string
+	for _, name := range []string{"data.json", "data.1.json", "data.2.json", "data.3.json"} {
+		part := readFile(t, filepath.Join(dir, name))
+		if len(part) > 40 {
+			t.Errorf("%s has %d bytes", name, len(part))
+		}
+		for _, record := range readRecords(t, filepath.Join(dir, name)) {
+			ids = append(ids, record["id"].(string))
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "data.4.json")); err == nil {
+		t.Error("more parts than needed")
+	}
+	if got := strings.Join(ids, ","); got != "0,1,2,3,4,5,6,7,8,9" {
+		t.Errorf("parts hold %s", got)
+	}
+}
+
+func TestSeparatorEscapes(t *testing.T) {
+	for separator, want := range map[string]rune{"comma": ',', "semicolon": ';', "tab": '\t', `\t`: '\t', `\x1f`: '\x1f', "|": '|'} {
+		comma, err := parseSeparator(separator)
+		if err != nil || comma != want {
+			t.Errorf("parseSeparator(%q) = %q, %v, want %q", separator, comma, err, want)
+		}
+	}
+	for _, separator := range []string{`"`, `\n`, "ab", `\x`, ""} {
+		if _, err := parseSeparator(separator); err == nil {
+			t.Errorf("parseSeparator(%q) should fail", separator)
+		}
+	}
+	dir := t.TempDir()
+	for separator, data := range map[string]string{`\t`: "a\tb\n1\t2\n", `\x1f`: "a\x1fb\n1\x1f2\n"} {
+		input := writeFile(t, dir, "data.csv", data)
+		convert(t, "-quiet", "-separator", separator, input)
+		if got := readFile(t, filepath.Join(dir, "data.json")); got != `[{"a":"1","b":"2"}]` {
+			t.Errorf("-separator %s: got %s", separator, got)
+		}
+	}
+}
+
+func TestSchemaFile(t *testing.T) {
+	dir := t.TempDir()
+	schema := writeFile(t, dir, "schema.json", `{"n":"int","f":"float","b":"bool","d":"date","s":"string"}`)
+	input := writeFile(t, dir, "data.csv", "n,f,b,d,s,other\n1,2.5,true,2023-12-31,007,9\n,,,,,\nx,1,true,2023-01-01,a,b\n")
+	result := convert(t, "-quiet", "-schema-file", schema, input)
+	got := readFile(t, filepath.Join(dir, "data.json"))
+	want := `[{"b":true,"d":"2023-12-31","f":2.5,"n":1,"other":"9","s":"007"},{"b":null,"d":null,"f":null,"n":null,"other":"","s":""}]`
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if !strings.Contains(result.stderr, `Column n value "x" is not a valid int`) {
+		t.Errorf("the row with a bad int wasn't reported: %s", result.stderr)
+	}
+	bad := writeFile(t, dir, "bad.json", `{"n":"blob"}`)
+	if result := runTool(t, "-schema-file", bad, input); result.code != exitUsage || !strings.Contains(result.stderr, "unknown type blob") {
+		t.Errorf("got exit %d for an unknown type: %s", result.code, result.stderr)
+	}
+	missing := writeFile(t, dir, "missing.json", `{"nope":"int"}`)
+	if result := runTool(t, "-schema-file", missing, input); result.code != exitParse || !strings.Contains(result.stderr, "Schema column nope is not in the header") {
+		t.Errorf("got exit %d for a column not in the file: %s", result.code, result.stderr)
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "id\n1\n")
+	empty := writeFile(t, dir, "empty.csv", "")
+	headerOnly := writeFile(t, dir, "header.csv", "id\n")
+	for _, test := range []struct {
+		name string
+		args []string
+		code int
+	}{
+		{"missing path", nil, exitUsage},
+		{"bad flag value", []string{"-extra", "keep", input}, exitUsage},
+		{"not a csv", []string{writeFile(t, dir, "data.txt", "id\n")}, exitUsage},
+		{"missing file", []string{filepath.Join(dir, "nope.csv")}, exitNotFound},
+		{"no header", []string{empty}, exitParse},
+		{"unwritable output", []string{"-output", filepath.Join(dir, "nodir", "out.json"), input}, exitWrite},
+		{"no records", []string{"-require-records", headerOnly}, 1},
+	} {
+		if result := runTool(t, append([]string{"-quiet"}, test.args...)...); result.code != test.code {
+			t.Errorf("%s: got exit %d, want %d: %s", test.name, result.code, test.code, result.stderr)
+		}
+	}
+}
+
+func TestMaxRecordSize(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "id,note\n1,ok\n2,\"never closed"+strings.Repeat("x", 5000)+"\n3,c\n")
+	result := runTool(t, "-quiet", "-max-record-size", "1KB", input)
+	if result.code != exitParse || !strings.Contains(result.stderr, "Record starting around line 3 is larger than 1024 bytes, possible unterminated quote") {
+		t.Errorf("got exit %d: %s", result.code, result.stderr)
+	}
+	// the default limit is far above a normal record.
+	if result := runTool(t, "-quiet", input); strings.Contains(result.stderr, "larger than") {
+		t.Errorf("the default limit tripped: %s", result.stderr)
+	}
+}
+
+func TestLinesArray(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "id,name\n1,a\n2,b\n")
+	convert(t, "-quiet", "-format", "lines-array", "-pretty", input)
+	got := readFile(t, filepath.Join(dir, "data.json"))
+	lines := strings.Split(got, "\n")
+	want := []string{"[", `{"id":"1","name":"a"},`, `{"id":"2","name":"b"}`, "]"}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("got %q, want %q", lines, want)
+	}
+	readRecords(t, filepath.Join(dir, "data.json"))
+}
+
+func TestMatch(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "id,email\n1,a@example.com\n2,b@other.org\n3,c@example.com\n")
+	reportPath := filepath.Join(dir, "report.json")
+	convert(t, "-quiet", "-match", `email=@example\.com$`, "-report", reportPath, input)
+	got := readFile(t, filepath.Join(dir, "data.json"))
+	if want := `[{"email":"a@example.com","id":"1"},{"email":"c@example.com","id":"3"}]`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if report := readFile(t, reportPath); !strings.Contains(report, `"rows_filtered": 1`) {
+		t.Errorf("the row that didn't match isn't counted as filtered: %s", report)
+	}
+	if result := runTool(t, "-match", "email=(", input); result.code != exitUsage || !strings.Contains(result.stderr, "Invalid -match regex") {
+		t.Errorf("got exit %d for a bad regex: %s", result.code, result.stderr)
+	}
+	if result := runTool(t, "-match", "nope=x", input); result.code != exitParse || !strings.Contains(result.stderr, "Match column nope is not in the header") {
+		t.Errorf("got exit %d for an unknown column: %s", result.code, result.stderr)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	result := runTool(t)
+	if result.code != exitUsage || !strings.Contains(result.stderr, "error: A filepath argument is required") {
+		t.Errorf("got exit %d: %s", result.code, result.stderr)
+	}
+	for _, want := range []string{"Usage:", "Options:", "-separator", "Examples:"} {
+		if !strings.Contains(result.stderr, want) {
+			t.Errorf("usage is missing %q: %s", want, result.stderr)
+		}
+	}
+	if result.stdout != "" {
+		t.Errorf("usage went to stdout: %s", result.stdout)
+	}
+	// -h asks for the usage, which isn't an error.
+	if result := runTool(t, "-h"); !strings.Contains(result.stderr, "Examples:") {
+		t.Errorf("-h doesn't print the examples: %s", result.stderr)
+	}
+}
+
+func TestNoUsableHeader(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{"bom.csv": "\xef\xbb\xbf", "blank.csv": "  \n\t\n\n"} {
+		result := runTool(t, "-quiet", writeFile(t, dir, name, content))
+		if result.code != exitParse || !strings.Contains(result.stderr, "No usable header row found") {
+			t.Errorf("%s: got exit %d: %s", name, result.code, result.stderr)
+		}
+	}
+	// a byte order mark in front of a real header is dropped.
+	input := writeFile(t, dir, "data.csv", "\xef\xbb\xbfid\n1\n")
+	convert(t, "-quiet", input)
+	if got := readFile(t, filepath.Join(dir, "data.json")); got != `[{"id":"1"}]` {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestSeparatorList(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "a;b\n1;2\n")
+	reportPath := filepath.Join(dir, "report.json")
+	// comma leaves the header in one column, so semicolon is picked.
+	convert(t, "-quiet", "-separators", "comma,semicolon,tab", "-report", reportPath, input)
+	if got := readFile(t, filepath.Join(dir, "data.json")); got != `[{"a":"1","b":"2"}]` {
+		t.Errorf("got %s", got)
+	}
+	if report := readFile(t, reportPath); !strings.Contains(report, `"separator": "semicolon"`) {
+		t.Errorf("the report doesn't name the separator used: %s", report)
+	}
+	result := runTool(t, "-quiet", "-separators", "comma,tab", input)
+	if result.code != exitParse || !strings.Contains(result.stderr, "None of the separators comma,tab split the header") {
+		t.Errorf("got exit %d: %s", result.code, result.stderr)
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "status,qty,note\n,,\nnew,5,x\n")
+	convert(t, "-quiet", "-defaults", "status=active,qty=0", input)
+	got := readFile(t, filepath.Join(dir, "data.json"))
+	if want := `[{"note":"","qty":"0","status":"active"},{"note":"x","qty":"5","status":"new"}]`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if result := runTool(t, "-defaults", "nope=1", input); result.code != exitParse || !strings.Contains(result.stderr, "Default column nope is not in the header") {
+		t.Errorf("got exit %d: %s", result.code, result.stderr)
+	}
+	if result := runTool(t, "-defaults", "qty", input); result.code != exitUsage {
+		t.Errorf("got exit %d for a default without a value", result.code)
+	}
+}
+
+func TestPageSize(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "id\n1\n2\n3\n4\n5\n")
+	convert(t, "-quiet", "-page-size", "2", input)
+	for name, want := range map[string]string{
+		"data.000.json": `[{"id":"1"},{"id":"2"}]`,
+		"data.001.json": `[{"id":"3"},{"id":"4"}]`,
+		"data.002.json": `[{"id":"5"}]`,
+	} {
+		if got := readFile(t, filepath.Join(dir, name)); got != want {
+			t.Errorf("%s: got %s, want %s", name, got, want)
+		}
+	}
+	for _, name := range []string{"data.json", "data.003.json"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			t.Errorf("%s was written", name)
+		}
+	}
+}
+
+func TestDateLayout(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "when\n31/12/2023\n31/12/2023 10:30\n2023-12-31\nsoon\n")
+	convert(t, "-quiet", "-typed", "-date-layout", "02/01/2006", "-date-layout", "02/01/2006 15:04", input)
+	got := readFile(t, filepath.Join(dir, "data.json"))
+	want := `[{"when":"2023-12-31"},{"when":"2023-12-31T10:30:00Z"},{"when":"2023-12-31"},{"when":"soon"}]`
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	// a schema date column that matches no layout skips the row.
+	schema := writeFile(t, dir, "schema.json", `{"when":"date"}`)
+	result := convert(t, "-quiet", "-schema-file", schema, "-date-layout", "02/01/2006", input)
+	got = readFile(t, filepath.Join(dir, "data.json"))
+	if want := `[{"when":"2023-12-31"},{"when":"2023-12-31"}]`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if !strings.Contains(result.stderr, `Column when value "soon" is not a valid date`) {
+		t.Errorf("the bad date wasn't reported: %s", result.stderr)
+	}
+}
+
+func TestIdentifiersStayStrings(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "id,phone,code,flag,n\n007,+1-800,1e3,true,0042\n")
+	convert(t, "-quiet", input)
+	got := readFile(t, filepath.Join(dir, "data.json"))
+	if want := `[{"code":"1e3","flag":"true","id":"007","n":"0042","phone":"+1-800"}]`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestWithMeta(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "id,name\n1,a\n2,b\n")
+	convert(t, "-quiet", "-with-meta", input)
+	var wrapped struct {
+		Records []map[string]string `json:"records"`
+		Meta    struct {
+			Columns []string `json:"columns"`
+			Count   int      `json:"count"`
+		} `json:"_meta"`
+	}
+	decodeJSON(t, readFile(t, filepath.Join(dir, "data.json")), &wrapped)
+	if strings.Join(wrapped.Meta.Columns, ",") != "id,name" || wrapped.Meta.Count != 2 {
+		t.Errorf("got meta %+v", wrapped.Meta)
+	}
+	if len(wrapped.Records) != 2 || wrapped.Records[1]["name"] != "b" {
+		t.Errorf("got records %v", wrapped.Records)
+	}
+}
+
+func TestSkipBlank(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "a,b\n1,2\n,\n,\n3,4\n,\n")
+	convert(t, "-quiet", input)
+	got := readFile(t, filepath.Join(dir, "data.json"))
+	if want := `[{"a":"1","b":"2"},{"a":"","b":""},{"a":"","b":""},{"a":"3","b":"4"}]`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	convert(t, "-quiet", "-skip-blank", input)
+	got = readFile(t, filepath.Join(dir, "data.json"))
+	if want := `[{"a":"1","b":"2"},{"a":"3","b":"4"}]`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func runPipeline(tb testing.TB, fileData inputFile) *conversionReport {
+	// the reader and writer goroutines wired up as main does, without
+	// -sort-by or a preview.
+	tb.Helper()
+	report := &conversionReport{Input: fileData.filepath}
+	writerChannel := make(chan map[string]interface{}, fileData.chanBuffer)
+	headerChecked := make(chan bool)
+	done := make(chan bool)
+	go processCsvFile(fileData, writerChannel, headerChecked, report)
+	<-headerChecked
+	go writeJSONFile(fileData, writerChannel, done, report)
+	<-done
+	return report
+}
+
+func pipelineInput(tb testing.TB, rows int) inputFile {
+	// a file of rows with a few columns and the options main would set for
+	// it.
+	tb.Helper()
+	var data strings.Builder
+	data.WriteString("id,name,email,amount\n")
+	for i := 0; i < rows; i++ {
+		fmt.Fprintf(&data, "%d,name %d,user%d@example.com,%d.50\n", i, i, i, i)
+	}
+	dir := tb.TempDir()
+	path := filepath.Join(dir, "data.csv")
+	if err := os.WriteFile(path, []byte(data.String()), 0644); err != nil {
+		tb.Fatal(err)
+	}
+	return inputFile{
+		filepath:    path,
+		separator:   "comma",
+		comma:       ',',
+		quote:       '"',
+		extra:       "error",
+		maxRecord:   1 << 20,
+		format:      "json",
+		quiet:       true,
+		output:      filepath.Join(dir, "data.json"),
+		reuseRecord: true,
+	}
+}
+
+func TestChanBuffer(t *testing.T) {
+	// the records and their order don't depend on the buffer.
+	fileData := pipelineInput(t, 500)
+	var want string
+	for _, size := range []int{0, 1, 64, 1000} {
+		fileData.chanBuffer = size
+		report := runPipeline(t, fileData)
+		got := readFile(t, fileData.output)
+		if report.RowsWritten != 500 {
+			t.Errorf("-chan-buffer %d wrote %d records", size, report.RowsWritten)
+		}
+		if want == "" {
+			want = got
+		} else if got != want {
+			t.Errorf("-chan-buffer %d changed the output", size)
+		}
+	}
+	if result := runTool(t, "-chan-buffer", "-1", fileData.filepath); result.code != exitUsage {
+		t.Errorf("got exit %d for a negative buffer", result.code)
+	}
+}
+
+func BenchmarkChanBuffer(b *testing.B) {
+	for _, size := range []int{0, 64, 1024} {
+		b.Run(fmt.Sprintf("buffer-%d", size), func(b *testing.B) {
+			fileData := pipelineInput(b, 10000)
+			fileData.chanBuffer = size
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				runPipeline(b, fileData)
+			}
+		})
+	}
+}
+
+func TestReportStats(t *testing.T) {
+	// the report the pipeline fills in matches the input and the file
+	// written.
+	fileData := pipelineInput(t, 20)
+	report := runPipeline(t, fileData)
+	if report.RowsRead != 20 || report.RowsWritten != 20 || report.RowsSkipped != 0 || report.RowsFiltered != 0 {
+		t.Errorf("got counts %+v", report)
+	}
+	if want := []string{"id", "name", "email", "amount"}; !reflect.DeepEqual(report.Columns, want) {
+		t.Errorf("got columns %v, want %v", report.Columns, want)
+	}
+	if output := readFile(t, fileData.output); report.BytesWritten != int64(len(output)) {
+		t.Errorf("got %d bytes written, the file has %d", report.BytesWritten, len(output))
+	}
+}
+
+func TestPreview(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "id,name\n1,ann\n2,bo\n3,c\n")
+	result := convert(t, "-quiet", "-preview", "2", "-source-key", "file", input)
+	want := "id  name  file\n1   ann   data.csv\n2   bo    data.csv\n"
+	if result.stdout != want {
+		t.Errorf("got\n%s\nwant\n%s", result.stdout, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "data.json")); err == nil {
+		t.Error("-preview wrote a JSON file")
+	}
+}
+
+func TestFloatFormat(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "price,qty\n1.5,2\n2.125,3\n")
+	convert(t, "-quiet", "-typed", "-float-fmt", "%.2f", input)
+	got := readFile(t, filepath.Join(dir, "data.json"))
+	// whole numbers are ints and keep their form.
+	if want := `[{"price":1.50,"qty":2},{"price":2.12,"qty":3}]`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	convert(t, "-quiet", "-typed", "-float-fmt", "%e", input)
+	got = readFile(t, filepath.Join(dir, "data.json"))
+	if want := `[{"price":1.500000e+00,"qty":2},{"price":2.125000e+00,"qty":3}]`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if result := runTool(t, "-typed", "-float-fmt", "%d", input); result.code != exitUsage {
+		t.Errorf("got exit %d for a verb that isn't a float format", result.code)
+	}
+}
+
+func TestSingleColumnWarning(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "a;b\n1;2\n")
+	result := convert(t, input)
+	if !strings.Contains(result.stderr, "Warning: every row has a single column, the file may use a different separator, try -separator semicolon") {
+		t.Errorf("no warning for a semicolon file read as comma: %s", result.stderr)
+	}
+	// it's only a warning, the file is still converted.
+	if got := readFile(t, filepath.Join(dir, "data.json")); got != `[{"a;b":"1;2"}]` {
+		t.Errorf("got %s", got)
+	}
+	result = convert(t, "-separator", "semicolon", input)
+	if strings.Contains(result.stderr, "Warning") {
+		t.Errorf("warning with the right separator: %s", result.stderr)
+	}
+}
+
+func TestInferColumns(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "n,m,f,b\n1,1,1,true\nx,2,2.5,false\n,3,,\n")
+	convert(t, "-quiet", "-infer-columns", input)
+	got := readFile(t, filepath.Join(dir, "data.json"))
+	// the stray x keeps n strings, ints and floats mixed are floats, and
+	// empty cells of a typed column are null.
+	want := `[{"b":true,"f":1,"m":1,"n":"1"},{"b":false,"f":2.5,"m":2,"n":"x"},{"b":null,"f":null,"m":3,"n":""}]`
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestAppend(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "id\n1\n2\n")
+	output := filepath.Join(dir, "data.json")
+	for existing, want := range map[string]string{
+		"":                         `[{"id":"1"},{"id":"2"}]`,
+		"[]\n":                     `[{"id":"1"},{"id":"2"}]`,
+		"[\n  {\"id\":\"0\"}\n]\n": `[{"id":"0"},{"id":"1"},{"id":"2"}]`,
+	} {
+		os.Remove(output)
+		if existing != "" {
+			writeFile(t, dir, "data.json", existing)
+		}
+		convert(t, "-quiet", "-append", input)
+		var got, wantRecords interface{}
+		decodeJSON(t, readFile(t, output), &got)
+		decodeJSON(t, want, &wantRecords)
+		if !reflect.DeepEqual(got, wantRecords) {
+			t.Errorf("appending to %q gave %s, want %s", existing, readFile(t, output), want)
+		}
+	}
+	writeFile(t, dir, "data.json", `{"id":"0"}`)
+	if result := runTool(t, "-quiet", "-append", input); result.code != exitWrite || !strings.Contains(result.stderr, "doesn't end with a JSON array") {
+		t.Errorf("got exit %d appending to an object: %s", result.code, result.stderr)
+	}
+}
+
+func TestStatusStream(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "id\n1\n")
+	// stdout is clean by default, so only data could ever go there.
+	result := convert(t, input)
+	if result.stdout != "" || !strings.Contains(result.stderr, "Completed!") {
+		t.Errorf("got stdout %q, stderr %q", result.stdout, result.stderr)
+	}
+	result = convert(t, "-status-stdout", input)
+	if !strings.Contains(result.stdout, "Completed!") || result.stderr != "" {
+		t.Errorf("got stdout %q, stderr %q with -status-stdout", result.stdout, result.stderr)
+	}
+	// data on stdout can't share it with the status.
+	if result := runTool(t, "-status-stdout", "-output", "-", input); result.code != exitUsage {
+		t.Errorf("got exit %d for -status-stdout with -output -", result.code)
+	}
+	result = convert(t, "-output", "-", input)
+	if result.stdout != `[{"id":"1"}]` {
+		t.Errorf("got stdout %q", result.stdout)
+	}
+}
+
+func TestReusedRecordsStayIntact(t *testing.T) {
+	// every path that keeps a row past the next read copies it: collected
+	// extra fields, held empty rows, -infer-columns and -sort-by.
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "a,b\n3,x,p\n,\n1,y,q\n2,z,r\n")
+	convert(t, "-quiet", "-extra", "collect", "-infer-columns", "-sort-by", "a", input)
+	got := readFile(t, filepath.Join(dir, "data.json"))
+	want := `[{"a":null,"b":""},{"_extra":["q"],"a":1,"b":"y"},{"_extra":["r"],"a":2,"b":"z"},{"_extra":["p"],"a":3,"b":"x"}]`
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func BenchmarkReuseRecord(b *testing.B) {
+	// the whole pipeline over 10000 rows, allocs/op drops by about one
+	// slice per row with the record slice reused.
+	for _, reuse := range []bool{false, true} {
+		b.Run(fmt.Sprintf("reuse-%t", reuse), func(b *testing.B) {
+			fileData := pipelineInput(b, 10000)
+			fileData.reuseRecord = reuse
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				runPipeline(b, fileData)
+			}
+		})
+	}
+}
+
+func firstNames(t *testing.T, data string) string {
+	var records []map[string]interface{}
+	decodeJSON(t, data, &records)
+	var names []string
+	for _, record := range records {
+		names = append(names, record["first"].(string))
+	}
+	return strings.Join(names, " ")
+}
+
+func TestSortBy(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "last,first,age\nb,x,10\na,z,9\nb,a,2\na,y,10\n")
+	convert(t, "-quiet", "-sort-by", "last,first:desc", input)
+	got := firstNames(t, readFile(t, filepath.Join(dir, "data.json")))
+	// the ties on last are broken by first, high to low.
+	if want := "z y x a"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	// typed numbers compare as numbers, equal ones keep their input order.
+	convert(t, "-quiet", "-typed", "-sort-by", "age:desc", input)
+	got = firstNames(t, readFile(t, filepath.Join(dir, "data.json")))
+	if want := "x y z a"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	// a -compute field can be sorted on like a column.
+	convert(t, "-quiet", "-compute", "name=last+first", "-sort-by", "name", input)
+	got = firstNames(t, readFile(t, filepath.Join(dir, "data.json")))
+	if want := "y z a x"; got != want {
+		t.Errorf("got %s sorting on a computed field, want %s", got, want)
+	}
+	// an unknown column fails with the header, before any output is made.
+	os.Remove(filepath.Join(dir, "data.json"))
+	if result := runTool(t, "-quiet", "-sort-by", "nope", input); result.code != exitParse || !strings.Contains(result.stderr, "Sort column nope is not in the header") {
+		t.Errorf("got exit %d: %s", result.code, result.stderr)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "data.json")); err == nil {
+		t.Error("a failing -sort-by column left data.json behind")
+	}
+	if result := runTool(t, "-sort-by", "age:up", input); result.code != exitUsage {
+		t.Errorf("got exit %d for a bad direction", result.code)
+	}
+}
+
+func TestColumnsFile(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "id,name,email\n1,a,a@x\n")
+	columns := writeFile(t, dir, "columns.txt", "email\n\n  name \n")
+	convert(t, "-quiet", "-columns-file", columns, input)
+	got := readFile(t, filepath.Join(dir, "data.json"))
+	if want := `[{"email":"a@x","name":"a"}]`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	unknown := writeFile(t, dir, "unknown.txt", "id\nphone\n")
+	if result := runTool(t, "-columns-file", unknown, input); result.code != exitParse || !strings.Contains(result.stderr, "Listed column phone is not in the header") {
+		t.Errorf("got exit %d: %s", result.code, result.stderr)
+	}
+}
+
+func TestErrorFile(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "id,name\n1,a\n2\n3,c,extra\n4,d\n")
+	errorPath := filepath.Join(dir, "errors.csv")
+	convert(t, "-quiet", "-error-file", errorPath, input)
+	want := "line_number,reason,raw\n" +
+		"3,Line doesn't match headers format. Skipping,2\n" +
+		"4,Line doesn't match headers format. Skipping,\"3,c,extra\"\n"
+	if got := readFile(t, errorPath); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+	if got := readFile(t, filepath.Join(dir, "data.json")); got != `[{"id":"1","name":"a"},{"id":"4","name":"d"}]` {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestCompute(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "first,last\nann,lee\nbo,\n")
+	convert(t, "-quiet", "-compute", "full=first+' '+last", "-compute", "tag='['+first+']'", input)
+	got := readFile(t, filepath.Join(dir, "data.json"))
+	want := `[{"first":"ann","full":"ann lee","last":"lee","tag":"[ann]"},{"first":"bo","full":"bo ","last":"","tag":"[bo]"}]`
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	for _, test := range []struct {
+		expression string
+		code       int
+		message    string
+	}{
+		{"full=first+nope", exitParse, "Compute column nope is not in the header"},
+		{"first=last", exitParse, "Compute field first is already a column in the header"},
+		{"full=first+", exitUsage, "is missing a term"},
+	} {
+		result := runTool(t, "-quiet", "-compute", test.expression, input)
+		if result.code != test.code || !strings.Contains(result.stderr, test.message) {
+			t.Errorf("-compute %s: got exit %d: %s", test.expression, result.code, result.stderr)
+		}
+	}
+}
+
+func TestConfig(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "a;b\n1;2\n")
+	config := writeFile(t, dir, "config.json", `{"separator":"semicolon","pretty":true,"quiet":true}`)
+	result := convert(t, "-config", config, "-output", "-", input)
+	if want := "[\n  {\n    \"a\": \"1\",\n    \"b\": \"2\"\n  }\n]"; result.stdout != want {
+		t.Errorf("got %q, want %q", result.stdout, want)
+	}
+	// a flag on the command line wins over the config.
+	result = convert(t, "-config", config, "-pretty=false", "-output", "-", input)
+	if result.stdout != `[{"a":"1","b":"2"}]` {
+		t.Errorf("got %s with -pretty=false", result.stdout)
+	}
+	unknown := writeFile(t, dir, "unknown.json", `{"nope":1}`)
+	if result := runTool(t, "-config", unknown, input); result.code != exitUsage || !strings.Contains(result.stderr, "has unknown option nope") {
+		t.Errorf("got exit %d: %s", result.code, result.stderr)
+	}
+	if result := runTool(t, "-config", filepath.Join(dir, "missing.json"), input); result.code != exitNotFound {
+		t.Errorf("got exit %d for a missing config", result.code)
+	}
+}
+
+func TestSourceKey(t *testing.T) {
+	// every file of a directory gets its own name, so merged outputs stay
+	// traceable.
+	dir := t.TempDir()
+	writeFile(t, dir, "a.csv", "id\n1\n2\n")
+	writeFile(t, dir, "b.csv", "id\n3\n")
+	convert(t, "-quiet", "-source-key", "__file", dir)
+	for name, want := range map[string]string{
+		"a.json": `[{"__file":"a.csv","id":"1"},{"__file":"a.csv","id":"2"}]`,
+		"b.json": `[{"__file":"b.csv","id":"3"}]`,
+	} {
+		if got := readFile(t, filepath.Join(dir, name)); got != want {
+			t.Errorf("%s: got %s, want %s", name, got, want)
+		}
+	}
+	if result := runTool(t, "-quiet", "-source-key", "id", filepath.Join(dir, "a.csv")); result.code != exitParse || !strings.Contains(result.stderr, "Source key id is already a column in the header") {
+		t.Errorf("got exit %d: %s", result.code, result.stderr)
+	}
+}
+
+func TestPrettyIndents(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "a.b,c\n1,2\n3,4\n")
+	result := convert(t, "-quiet", "-pretty", "-array-indent", "4", "-object-indent", "1", "-nest", "-output", "-", input)
+	want := `[
+    {
+     "a": {
+      "b": "1"
+     },
+     "c": "2"
+    },
+    {
+     "a": {
+      "b": "3"
+     },
+     "c": "4"
+    }
+]`
+	if result.stdout != want {
+		t.Errorf("got\n%s\nwant\n%s", result.stdout, want)
+	}
+}
+
+func TestTSVUnescape(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "a\tb\nx\\ty\t1\\\\2\\n\n")
+	convert(t, "-quiet", "-separator", "tab", "-tsv-unescape", input)
+	var records []map[string]string
+	decodeJSON(t, readFile(t, filepath.Join(dir, "data.json")), &records)
+	if want := []map[string]string{{"a": "x\ty", "b": "1\\2\n"}}; !reflect.DeepEqual(records, want) {
+		t.Errorf("got %q, want %q", records, want)
+	}
+	// without it the backslashes are kept.
+	convert(t, "-quiet", "-separator", "tab", input)
+	decodeJSON(t, readFile(t, filepath.Join(dir, "data.json")), &records)
+	if want := []map[string]string{{"a": `x\ty`, "b": `1\\2\n`}}; !reflect.DeepEqual(records, want) {
+		t.Errorf("got %q, want %q", records, want)
+	}
+}
+
+func TestRequireRecords(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "id\n")
+	convert(t, "-quiet", input)
+	result := runTool(t, "-quiet", "-require-records", input)
+	if result.code != 1 || !strings.Contains(result.stderr, "No records were written") {
+		t.Errorf("got exit %d for a header only file: %s", result.code, result.stderr)
+	}
+	// rows that are all skipped count as nothing written too.
+	input = writeFile(t, dir, "data.csv", "id,name\n1\n")
+	if result := runTool(t, "-quiet", "-require-records", input); result.code != 1 {
+		t.Errorf("got exit %d when every row was skipped", result.code)
+	}
+	input = writeFile(t, dir, "data.csv", "id\n1\n")
+	convert(t, "-quiet", "-require-records", input)
+}
+
+func TestURLInput(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.csv" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv")
+		io.WriteString(w, "id,name\n1,ann\n2,bo\n")
+	}))
+	defer server.Close()
+	output := filepath.Join(t.TempDir(), "out.json")
+	// a URL needs no .csv extension.
+	for _, path := range []string{"/data.csv", "/export?id=3"} {
+		convert(t, "-quiet", "-output", output, server.URL+path)
+		if got := readFile(t, output); got != `[{"id":"1","name":"ann"},{"id":"2","name":"bo"}]` {
+			t.Errorf("%s: got %s", path, got)
+		}
+	}
+	result := runTool(t, "-quiet", "-output", output, server.URL+"/missing.csv")
+	if result.code != exitNotFound || !strings.Contains(result.stderr, "404") {
+		t.Errorf("got exit %d: %s", result.code, result.stderr)
+	}
+}
+
+func TestStreamWriterSink(t *testing.T) {
+	// the writer only needs an io.WriteCloser, there is no seeking.
+	var sink bytes.Buffer
+	write := streamStringWriter(nopWriteCloser{&sink})
+	write("[", false)
+	write(`{"id":"1"}`, false)
+	write("]", true)
+	if got := sink.String(); got != `[{"id":"1"}]` {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestAppendToPipe(t *testing.T) {
+	// a pipe can't be read back and cut short, so -append writes a fresh
+	// array to it.
+	if _, err := os.Stat("/dev/stdout"); err != nil {
+		t.Skip("no /dev/stdout")
+	}
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "id\n1\n")
+	result := convert(t, "-quiet", "-append", "-output", "/dev/stdout", input)
+	if result.stdout != `[{"id":"1"}]` {
+		t.Errorf("got %q", result.stdout)
+	}
+}
+
+func TestNonFinite(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "v,n\n1e999,1e999\n-Inf,Inf\nNaN,1.5\n")
+	schema := writeFile(t, dir, "schema.json", `{"v":"float"}`)
+	for policy, want := range map[string]string{
+		"null":   `[{"n":"1e999","v":null},{"n":"Inf","v":null},{"n":"1.5","v":null}]`,
+		"string": `[{"n":"1e999","v":"+Inf"},{"n":"Inf","v":"-Inf"},{"n":"1.5","v":"NaN"}]`,
+	} {
+		// -typed leaves n alone, they aren't JSON numbers.
+		convert(t, "-quiet", "-typed", "-schema-file", schema, "-nonfinite", policy, input)
+		if got := readFile(t, filepath.Join(dir, "data.json")); got != strings.Replace(want, `"1.5"`, "1.5", 1) {
+			t.Errorf("-nonfinite %s: got %s", policy, got)
+		}
+	}
+	result := runTool(t, "-quiet", "-schema-file", schema, "-nonfinite", "error", input)
+	if result.code != exitParse || !strings.Contains(result.stderr, "Line 2: Column v value \"1e999\" is not a finite number") {
+		t.Errorf("got exit %d: %s", result.code, result.stderr)
+	}
+	if result := runTool(t, "-nonfinite", "zero", input); result.code != exitUsage {
+		t.Errorf("got exit %d for an unknown policy", result.code)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "id,name\n1,a\n")
+	output := filepath.Join(dir, "data.json")
+	// the same input always gives the same sum.
+	for i := 0; i < 2; i++ {
+		convert(t, "-quiet", "-checksum", "sha256", input)
+		want := "6cad77a840675f6c00ae6c1807acb7ed45c9f4e5fc570f5f33b00eb40565159a  data.json\n"
+		if got := readFile(t, output+".sha256"); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+	convert(t, "-quiet", "-checksum", "sha512", input)
+	sum := sha512.Sum512([]byte(readFile(t, output)))
+	if got, want := readFile(t, output+".sha512"), hex.EncodeToString(sum[:])+"  data.json\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if result := runTool(t, "-checksum", "md5", input); result.code != exitUsage {
+		t.Errorf("got exit %d for md5", result.code)
+	}
+}
+
+func TestNestConflict(t *testing.T) {
+	// the column order doesn't matter, the value always meets the object
+	// nested under the same name.
+	dir := t.TempDir()
+	for header, want := range map[string]string{
+		"a,a.b,c": `[{"a":{"b":"2"},"c":"3"}]`,
+		"a.b,a,c": `[{"a":{"b":"1"},"c":"3"}]`,
+	} {
+		input := writeFile(t, dir, "data.csv", header+"\n1,2,3\n")
+		os.Remove(filepath.Join(dir, "data.json"))
+		result := runTool(t, "-quiet", "-nest", input)
+		if result.code != exitParse || !strings.Contains(result.stderr, "Column a is both a value and a parent of a.b") {
+			t.Errorf("%s: got exit %d: %s", header, result.code, result.stderr)
+		}
+		// the header alone shows the conflict, so nothing is written.
+		if _, err := os.Stat(filepath.Join(dir, "data.json")); err == nil {
+			t.Errorf("%s: the conflict left data.json behind", header)
+		}
+		convert(t, "-quiet", "-nest", "-nest-conflict", "overwrite", input)
+		if got := readFile(t, filepath.Join(dir, "data.json")); got != want {
+			t.Errorf("%s: got %s with overwrite, want %s", header, got, want)
+		}
+	}
+	// a -compute field counts as a column too.
+	input := writeFile(t, dir, "data.csv", "a.b\n1\n")
+	os.Remove(filepath.Join(dir, "data.json"))
+	if result := runTool(t, "-quiet", "-nest", "-compute", "a=a.b", input); result.code != exitParse || !strings.Contains(result.stderr, "Column a is both a value and a parent of a.b") {
+		t.Errorf("got exit %d for a computed parent: %s", result.code, result.stderr)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "data.json")); err == nil {
+		t.Error("the computed conflict left data.json behind")
+	}
+}
+
+func TestHeaderMarker(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "# exported 2024\nx,y\n#HEADER id,name\n1,a\n2,b\n")
+	convert(t, "-quiet", "-header-marker", "#HEADER ", input)
+	if got := readFile(t, filepath.Join(dir, "data.json")); got != `[{"id":"1","name":"a"},{"id":"2","name":"b"}]` {
+		t.Errorf("got %s", got)
+	}
+	result := runTool(t, "-quiet", "-header-marker", "#NOPE", input)
+	if result.code != exitParse || !strings.Contains(result.stderr, "Header marker #NOPE not found") {
+		t.Errorf("got exit %d: %s", result.code, result.stderr)
+	}
+}
+
+func TestPrettyIsCanonical(t *testing.T) {
+	// the default -pretty output is what json.Indent makes of the compact
+	// output, nested objects and arrays included.
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "id,tags,a.b\n1,x|y,2\n2,,3\n")
+	args := []string{"-quiet", "-nest", "-split-field", "tags:|", "-output", "-", input}
+	compact := convert(t, args...).stdout
+	pretty := convert(t, append([]string{"-pretty"}, args...)...).stdout
+	if !json.Valid([]byte(pretty)) {
+		t.Fatalf("not valid JSON: %s", pretty)
+	}
+	var want bytes.Buffer
+	if err := json.Indent(&want, []byte(compact), "", "  "); err != nil {
+		t.Fatal(err)
+	}
+	if pretty != want.String() {
+		t.Errorf("got\n%s\nwant\n%s", pretty, want.String())
+	}
+	golden := `[
+  {
+    "a": {
+      "b": "2"
+    },
+    "id": "1",
+    "tags": [
+      "x",
+      "y"
+    ]
+  },
+  {
+    "a": {
+      "b": "3"
+    },
+    "id": "2",
+    "tags": []
+  }
+]`
+	if pretty != golden {
+		t.Errorf("got\n%s\nwant\n%s", pretty, golden)
+	}
+}
+
+func TestUppercaseExtension(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "DATA.CSV", "id\n1\n")
+	convert(t, "-quiet", input)
+	// the extension is dropped in any case, not left as DATA.CSV.json.
+	if got := readFile(t, filepath.Join(dir, "DATA.json")); got != `[{"id":"1"}]` {
+		t.Errorf("got %s", got)
+	}
+	if result := runTool(t, writeFile(t, dir, "data.txt", "id\n1\n")); result.code != exitUsage {
+		t.Errorf("got exit %d for a .txt file", result.code)
+	}
+}
+
+func TestOutputPathJoin(t *testing.T) {
+	dir := t.TempDir()
+	nested := filepath.Join(dir, "a", "b")
+	fileData := inputFile{filepath: filepath.Join(nested, "data.csv"), format: "json"}
+	if got, want := getOutputPath(fileData, 0), filepath.Join(nested, "data.json"); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if got, want := getOutputPath(fileData, 2), filepath.Join(nested, "data.2.json"); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	fileData.output = filepath.Join(nested, "out.json")
+	fileData.pageSize = 10
+	if got, want := getOutputPath(fileData, 1), filepath.Join(nested, "out.001.json"); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestSeparatorSampleOnStdin(t *testing.T) {
+	// detection only peeks at the first lines, none of them are lost from
+	// a stream that can't be read twice.
+	result := runToolEnv(t, nil, "a;b\n1;2\n3;4\n", "-quiet", "-separators", "comma,semicolon", "-separator-sample", "2", "-output", "-", "-")
+	if result.code != 0 || result.stdout != `[{"a":"1","b":"2"},{"a":"3","b":"4"}]` {
+		t.Errorf("got exit %d, stdout %s: %s", result.code, result.stdout, result.stderr)
+	}
+	// a sample row that splits differently rules the separator out.
+	result = runToolEnv(t, nil, "a;b\n1,x;2\n", "-quiet", "-separators", "semicolon,comma", "-separator-sample", "2", "-output", "-", "-")
+	if result.code != 0 || result.stdout != `[{"a":"1,x","b":"2"}]` {
+		t.Errorf("got exit %d, stdout %s: %s", result.code, result.stdout, result.stderr)
+	}
+}
+
+func TestConcatFormat(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "id\n1\n2\n3\n")
+	result := convert(t, "-quiet", "-format", "concat", "-output", "-", input)
+	if result.stdout != `{"id":"1"}{"id":"2"}{"id":"3"}` {
+		t.Errorf("got %s", result.stdout)
+	}
+	// a streaming decoder reads it as a sequence of objects.
+	decoder := json.NewDecoder(strings.NewReader(result.stdout))
+	var ids []string
+	for {
+		var record map[string]string
+		if err := decoder.Decode(&record); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, record["id"])
+	}
+	if !reflect.DeepEqual(ids, []string{"1", "2", "3"}) {
+		t.Errorf("got %v", ids)
+	}
+}
+
+func TestMaxRows(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "id\n1\n2\n3\n")
+	convert(t, "-quiet", "-max-rows", "3", input)
+	if got := readFile(t, filepath.Join(dir, "data.json")); got != `[{"id":"1"},{"id":"2"},{"id":"3"}]` {
+		t.Errorf("got %s", got)
+	}
+	// the cap fires on the row after the Nth, line 4 of the file.
+	result := runTool(t, "-quiet", "-max-rows", "2", input)
+	if result.code != exitParse || !strings.Contains(result.stderr, "Input has more than 2 data rows, stopped at line 4") {
+		t.Errorf("got exit %d: %s", result.code, result.stderr)
+	}
+}
+
+func TestValidateCatchesBrokenOutput(t *testing.T) {
+	// a broken marshaler writing a trailing comma is caught before the file
+	// is created.
+	path := filepath.Join(t.TempDir(), "data.json")
+	writer := &validatingWriter{path: path, fileData: inputFile{format: "json"}}
+	io.WriteString(writer, `[{"id":"1",}]`)
+	if err := writer.Close(); err == nil || !strings.Contains(err.Error(), "is not valid JSON, nothing was written") {
+		t.Errorf("got %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("the file was created: %v", err)
+	}
+	writer = &validatingWriter{path: path, fileData: inputFile{format: "json"}}
+	io.WriteString(writer, `[{"id":"1"}]`)
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, path); got != `[{"id":"1"}]` {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "id\n1\n2\n")
+	for _, format := range []string{"json", "ndjson", "concat"} {
+		convert(t, "-quiet", "-validate", "-format", format, input)
+	}
+}
+
+func TestIndentTab(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "id,a.b\n1,2\n")
+	result := convert(t, "-quiet", "-pretty", "-indent", "tab", "-nest", "-output", "-", input)
+	if want := "[\n\t{\n\t\t\"a\": {\n\t\t\t\"b\": \"2\"\n\t\t},\n\t\t\"id\": \"1\"\n\t}\n]"; result.stdout != want {
+		t.Errorf("got %q, want %q", result.stdout, want)
+	}
+	result = convert(t, "-quiet", "-pretty", "-indent", "1", "-output", "-", input)
+	if want := "[\n {\n  \"a.b\": \"2\",\n  \"id\": \"1\"\n }\n]"; result.stdout != want {
+		t.Errorf("got %q, want %q", result.stdout, want)
+	}
+	if result := runTool(t, "-pretty", "-indent", "tabs", input); result.code != exitUsage {
+		t.Errorf("got exit %d for -indent tabs", result.code)
+	}
+}
+
+func TestSection(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "a,b\n1,2\n\n\nc\n3\n4\n")
+	convert(t, "-quiet", "-section", "2", input)
+	// the second block has its own header, several blank lines are one gap.
+	if got := readFile(t, filepath.Join(dir, "data.json")); got != `[{"c":"3"},{"c":"4"}]` {
+		t.Errorf("got %s", got)
+	}
+	convert(t, "-quiet", "-section", "1", input)
+	if got := readFile(t, filepath.Join(dir, "data.json")); got != `[{"a":"1","b":"2"}]` {
+		t.Errorf("got %s", got)
+	}
+	result := runTool(t, "-quiet", "-section", "3", input)
+	if result.code != exitParse || !strings.Contains(result.stderr, "Section 3 not found, the file has 2") {
+		t.Errorf("got exit %d: %s", result.code, result.stderr)
+	}
+}
+
+func TestDecimalComma(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "n;s\n1.234,56;x\n12,5;y\n-7;z\n")
+	convert(t, "-quiet", "-typed", "-decimal-comma", "-separator", "semicolon", input)
+	got := readFile(t, filepath.Join(dir, "data.json"))
+	if want := `[{"n":1234.56,"s":"x"},{"n":12.5,"s":"y"},{"n":-7,"s":"z"}]`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	// without it they aren't numbers.
+	convert(t, "-quiet", "-typed", "-separator", "semicolon", input)
+	got = readFile(t, filepath.Join(dir, "data.json"))
+	if want := `[{"n":"1.234,56","s":"x"},{"n":"12,5","s":"y"},{"n":-7,"s":"z"}]`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestRenameRegex(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "First Name,last-name!, E Mail\n1,2,3\n")
+	convert(t, "-quiet", "-rename-regex", "s/[^A-Za-z0-9]+/_/g", "-rename-regex", "s/^_|_$//g", input)
+	if got := readFile(t, filepath.Join(dir, "data.json")); got != `[{"E_Mail":"3","First_Name":"1","last_name":"2"}]` {
+		t.Errorf("got %s", got)
+	}
+	input = writeFile(t, dir, "data.csv", "a b,a_b\n1,2\n")
+	result := runTool(t, "-quiet", "-rename-regex", "s/ /_/g", input)
+	if result.code != exitParse || !strings.Contains(result.stderr, "Headers a b and a_b both become a_b after -rename-regex") {
+		t.Errorf("got exit %d: %s", result.code, result.stderr)
+	}
+	if result := runTool(t, "-rename-regex", "s/(/x/g", input); result.code != exitUsage {
+		t.Errorf("got exit %d for a bad pattern", result.code)
+	}
+}
+
+func TestTypeField(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "id,__note\n1,\n2,x\n")
+	convert(t, "-quiet", "-type-field", "__type=user", input)
+	if got := readFile(t, filepath.Join(dir, "data.json")); got != `[{"__note":"","__type":"user","id":"1"},{"__note":"x","__type":"user","id":"2"}]` {
+		t.Errorf("got %s", got)
+	}
+	result := runTool(t, "-quiet", "-type-field", "id=user", input)
+	if result.code != exitParse || !strings.Contains(result.stderr, "Type field id is already a column in the header") {
+		t.Errorf("got exit %d: %s", result.code, result.stderr)
+	}
+	if result := runTool(t, "-type-field", "user", input); result.code != exitUsage {
+		t.Errorf("got exit %d without a =", result.code)
+	}
+}
+
+func TestSingleQuote(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "id,name\n1,'a, b'\n2,'it''s \"x\"'\n3,plain\n")
+	convert(t, "-quiet", "-quote", "'", input)
+	var records []map[string]string
+	decodeJSON(t, readFile(t, filepath.Join(dir, "data.json")), &records)
+	want := []map[string]string{{"id": "1", "name": "a, b"}, {"id": "2", "name": `it's "x"`}, {"id": "3", "name": "plain"}}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("got %q, want %q", records, want)
+	}
+	if result := runTool(t, "-quote", "ab", input); result.code != exitUsage {
+		t.Errorf("got exit %d for a two character quote", result.code)
+	}
+}
+
+func TestOutputPermissionDenied(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can write to a read-only directory")
+	}
+	dir := t.TempDir()
+	input := writeFile(t, t.TempDir(), "data.csv", "id\n1\n")
+	if err := os.Chmod(dir, 0555); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(dir, 0755)
+	output := filepath.Join(dir, "data.json")
+	result := runTool(t, "-quiet", "-output", output, input)
+	if result.code != exitWrite || !strings.Contains(result.stderr, "Cannot write output file "+output+": permission denied") {
+		t.Errorf("got exit %d: %s", result.code, result.stderr)
+	}
+}
+
+func TestWithWarnings(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "id,name\n1,a\n2\n3,c\n")
+	convert(t, "-quiet", "-with-meta", "-with-warnings", input)
+	var document struct {
+		Records  []map[string]string `json:"records"`
+		Warnings []struct {
+			Line   int    `json:"line"`
+			Reason string `json:"reason"`
+		} `json:"_warnings"`
+	}
+	if err := json.Unmarshal([]byte(readFile(t, filepath.Join(dir, "data.json"))), &document); err != nil {
+		t.Fatal(err)
+	}
+	if len(document.Records) != 2 || len(document.Warnings) != 1 {
+		t.Fatalf("got %+v", document)
+	}
+	if warning := document.Warnings[0]; warning.Line != 3 || warning.Reason != "Line doesn't match headers format. Skipping" {
+		t.Errorf("got %+v", warning)
+	}
+	if result := runTool(t, "-with-warnings", input); result.code != exitUsage {
+		t.Errorf("got exit %d for -with-warnings without -with-meta", result.code)
+	}
+}
+
+func TestHeadColumns(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "c,a,b\n1,2,3\n")
+	// by position, not by name.
+	convert(t, "-quiet", "-head-columns", "2", input)
+	if got := readFile(t, filepath.Join(dir, "data.json")); got != `[{"a":"2","c":"1"}]` {
+		t.Errorf("got %s", got)
+	}
+	convert(t, "-quiet", "-head-columns", "5", input)
+	if got := readFile(t, filepath.Join(dir, "data.json")); got != `[{"a":"2","b":"3","c":"1"}]` {
+		t.Errorf("got %s with more than there are", got)
+	}
+}
+
+func TestRowHash(t *testing.T) {
+	dir := t.TempDir()
+	hashes := func(content string) []string {
+		t.Helper()
+		input := writeFile(t, dir, "data.csv", content)
+		convert(t, "-quiet", "-row-hash", "__hash", input)
+		var records []map[string]string
+		decodeJSON(t, readFile(t, filepath.Join(dir, "data.json")), &records)
+		var hashes []string
+		for _, record := range records {
+			hashes = append(hashes, record["__hash"])
+		}
+		return hashes
+	}
+	first := hashes("id,name\n1,a\n2,b\n")
+	if want := []string{"8705e312f74a8ea282cd4cd992b68df48c1b1163", first[1]}; !reflect.DeepEqual(first, want) {
+		t.Errorf("got %v", first)
+	}
+	// the same input, with its columns in another order, hashes the same.
+	if again := hashes("name,id\na,1\nb,2\n"); !reflect.DeepEqual(again, first) {
+		t.Errorf("got %v, then %v", first, again)
+	}
+	if changed := hashes("id,name\n1,a\n2,c\n"); changed[0] != first[0] || changed[1] == first[1] {
+		t.Errorf("got %v for a changed row, was %v", changed, first)
+	}
+}
+
+func TestReverseOutSeparator(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.json", `[{"a":"1","b":"x;y"},{"a":"2"}]`)
+	convert(t, "-quiet", "-reverse", "-out-separator", "semicolon", input)
+	// a value holding the separator is quoted.
+	if got, want := readFile(t, filepath.Join(dir, "data.csv")), "a;b\n1;\"x;y\"\n2;\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestStreamingPretty(t *testing.T) {
+	// records are indented one at a time, and the whole stream is still
+	// valid JSON.
+	fileData := pipelineInput(t, 3)
+	fileData.pretty = true
+	fileData.arrayIndent = "  "
+	fileData.objectIndent = "  "
+	runPipeline(t, fileData)
+	got := readFile(t, fileData.output)
+	if !json.Valid([]byte(got)) {
+		t.Fatalf("not valid JSON: %s", got)
+	}
+	var want strings.Builder
+	want.WriteString("[\n")
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			want.WriteString(",\n")
+		}
+		fmt.Fprintf(&want, "  {\n    \"amount\": \"%d.50\",\n    \"email\": \"user%d@example.com\",\n    \"id\": \"%d\",\n    \"name\": \"name %d\"\n  }", i, i, i, i)
+	}
+	want.WriteString("\n]")
+	if got != want.String() {
+		t.Errorf("got\n%s\nwant\n%s", got, want.String())
+	}
+}
+
+func TestNoBOMAllowed(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "\ufeffid\n1\n")
+	// by default the mark is dropped rather than read into the header.
+	convert(t, "-quiet", input)
+	if got := readFile(t, filepath.Join(dir, "data.json")); got != `[{"id":"1"}]` {
+		t.Errorf("got %s", got)
+	}
+	result := runTool(t, "-quiet", "-no-bom-allowed", input)
+	if result.code != exitParse || !strings.Contains(result.stderr, "starts with a UTF-8 byte order mark") {
+		t.Errorf("got exit %d: %s", result.code, result.stderr)
+	}
+	convert(t, "-quiet", "-no-bom-allowed", writeFile(t, dir, "plain.csv", "id\n1\n"))
+}
+
+func TestHeaderSeparator(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "id,name\n1\ta,b\n")
+	convert(t, "-quiet", "-header-separator", "comma", "-separator", "tab", input)
+	if got := readFile(t, filepath.Join(dir, "data.json")); got != `[{"id":"1","name":"a,b"}]` {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestChunkArray(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "id\n1\n2\n3\n4\n5\n")
+	result := convert(t, "-quiet", "-chunk-array", "2", "-output", "-", input)
+	decoder := json.NewDecoder(strings.NewReader(result.stdout))
+	var sizes []int
+	for {
+		var chunk []map[string]string
+		if err := decoder.Decode(&chunk); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("%v: %s", err, result.stdout)
+		}
+		sizes = append(sizes, len(chunk))
+	}
+	// one stream of complete arrays, the last one holds what is left.
+	if !reflect.DeepEqual(sizes, []int{2, 2, 1}) {
+		t.Errorf("got arrays of %v: %s", sizes, result.stdout)
+	}
+	if len(strings.Split(result.stdout, "\n")) != 3 {
+		t.Errorf("not one array per line: %q", result.stdout)
+	}
+}
+
+func TestStringColumns(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "zip,phone,n\n12345,5550100,7\n")
+	for _, mode := range []string{"-typed", "-infer-columns"} {
+		convert(t, "-quiet", mode, "-string-columns", "zip,phone", input)
+		if got := readFile(t, filepath.Join(dir, "data.json")); got != `[{"n":7,"phone":"5550100","zip":"12345"}]` {
+			t.Errorf("%s: got %s", mode, got)
+		}
+	}
+}
+
+func TestSummary(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "id,n,e\n1,2,\nx,3.5,\n")
+	result := convert(t, "-quiet", "-summary", input)
+	want := "column  non-empty  type\n" +
+		"id      2/2        string\n" +
+		"n       2/2        float\n" +
+		"e       0/2        -\n"
+	if result.stderr != want {
+		t.Errorf("got\n%s\nwant\n%s", result.stderr, want)
+	}
+}
+
+func TestNoPhantomTrailingRecord(t *testing.T) {
+	dir := t.TempDir()
+	for _, content := range []string{"a,b\n1,2\n", "a,b\n1,2\n\n", "a,b\n1,2\n,\n", "a,b\n1,2\n,\n,\n"} {
+		input := writeFile(t, dir, "data.csv", content)
+		convert(t, "-quiet", input)
+		if got := readFile(t, filepath.Join(dir, "data.json")); got != `[{"a":"1","b":"2"}]` {
+			t.Errorf("%q: got %s", content, got)
+		}
+	}
+	// a line of only separators in the middle is a real row.
+	input := writeFile(t, dir, "data.csv", "a,b\n,\n1,2\n,\n")
+	convert(t, "-quiet", input)
+	if got := readFile(t, filepath.Join(dir, "data.json")); got != `[{"a":"","b":""},{"a":"1","b":"2"}]` {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestBlankAsNullWithTrim(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "a,b,c\n   ,x,\n")
+	convert(t, "-quiet", "-trim", "-blank-as-null", input)
+	if got := readFile(t, filepath.Join(dir, "data.json")); got != `[{"a":null,"b":"x","c":null}]` {
+		t.Errorf("got %s", got)
+	}
+	// without -trim the spaces are a value.
+	convert(t, "-quiet", "-blank-as-null", input)
+	if got := readFile(t, filepath.Join(dir, "data.json")); got != `[{"a":"   ","b":"x","c":null}]` {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestColumnsFromFirst(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.json", `[{"a":"1","b":"2"},{"b":"3","c":"4"}]`)
+	convert(t, "-quiet", "-reverse", "-columns-from-first", input)
+	if got, want := readFile(t, filepath.Join(dir, "data.csv")), "a,b\n1,2\n,3\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	convert(t, "-quiet", "-reverse", input)
+	if got, want := readFile(t, filepath.Join(dir, "data.csv")), "a,b,c\n1,2,\n,3,4\n"; got != want {
+		t.Errorf("got %q without the flag, want %q", got, want)
+	}
+}
+
+func TestPreviewFormat(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "id,name\n1,a\n2,b\n")
+	result := convert(t, "-quiet", "-preview", "1", "-preview-format", "pretty", input)
+	if want := "[\n  {\n    \"id\": \"1\",\n    \"name\": \"a\"\n  }\n]\n"; result.stdout != want {
+		t.Errorf("got %q, want %q", result.stdout, want)
+	}
+	// the file written with the same options stays compact.
+	convert(t, "-quiet", "-preview-format", "pretty", input)
+	if got := readFile(t, filepath.Join(dir, "data.json")); got != `[{"id":"1","name":"a"},{"id":"2","name":"b"}]` {
+		t.Errorf("got %s", got)
+	}
+	result = convert(t, "-quiet", "-preview", "2", "-preview-format", "json", input)
+	if want := "[{\"id\":\"1\",\"name\":\"a\"},{\"id\":\"2\",\"name\":\"b\"}]\n"; result.stdout != want {
+		t.Errorf("got %q, want %q", result.stdout, want)
+	}
+}
+
+func TestValidateOnly(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "id,n\n1,2\n2\n3,4\n")
+	result := runTool(t, "-validate-only", input)
+	// the table covers every row read, the skipped one included.
+	want := "Line: [2]Error: Line doesn't match headers format. Skipping\n" +
+		"3 rows read, 2 valid, 1 skipped, 0 filtered\n" +
+		"column  non-empty  type\n" +
+		"id      3/3        int\n" +
+		"n       2/3        int\n"
+	if result.code != 0 || result.stderr != want || result.stdout != "" {
+		t.Errorf("got exit %d, stdout %q, stderr\n%s\nwant\n%s", result.code, result.stdout, result.stderr, want)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("-validate-only wrote %d files", len(entries)-1)
+	}
+}
+
+func TestNDJSONEmptyNull(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "id,e\n1,\n")
+	result := convert(t, "-quiet", "-ndjson-empty-null", "-format", "ndjson", "-output", "-", input)
+	if result.stdout != "{\"e\":null,\"id\":\"1\"}\n" {
+		t.Errorf("got %q with ndjson", result.stdout)
+	}
+	result = convert(t, "-quiet", "-ndjson-empty-null", "-output", "-", input)
+	if result.stdout != `[{"e":"","id":"1"}]` {
+		t.Errorf("got %q with json", result.stdout)
+	}
+}
+
+func TestSplitField(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "id,tags,roles\n1,a|b|c,x;y\n2,,z\n")
+	convert(t, "-quiet", "-split-field", "tags:|", "-split-field", "roles:;", input)
+	want := `[{"id":"1","roles":["x","y"],"tags":["a","b","c"]},{"id":"2","roles":["z"],"tags":[]}]`
+	if got := readFile(t, filepath.Join(dir, "data.json")); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if result := runTool(t, "-quiet", "-split-field", "nope:|", input); result.code != exitParse || !strings.Contains(result.stderr, "Split column nope is not in the header") {
+		t.Errorf("got exit %d for an unknown column: %s", result.code, result.stderr)
+	}
+}
+
+func TestReverseGzip(t *testing.T) {
+	dir := t.TempDir()
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	io.WriteString(writer, `[{"a":"1","b":"2"}]`)
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// the .json.gz extension is enough, the CSV goes next to it as data.csv.
+	input := writeFile(t, dir, "data.json.gz", compressed.String())
+	convert(t, "-quiet", "-reverse", input)
+	if got := readFile(t, filepath.Join(dir, "data.csv")); got != "a,b\n1,2\n" {
+		t.Errorf("got %q", got)
+	}
+	// any other name needs -gzip-in.
+	input = writeFile(t, dir, "other.json", compressed.String())
+	convert(t, "-quiet", "-reverse", "-gzip-in", input)
+	if got := readFile(t, filepath.Join(dir, "other.csv")); got != "a,b\n1,2\n" {
+		t.Errorf("got %q with -gzip-in", got)
+	}
+}
+
+func TestTypedArrays(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "n,b,s\n1,true,text\n2.5,false,x\n")
+	result := convert(t, "-quiet", "-typed", "-format", "arrays", "-output", "-", input)
+	if result.stdout != `[[1,true,"text"],[2.5,false,"x"]]` {
+		t.Errorf("got %s", result.stdout)
+	}
+	result = convert(t, "-quiet", "-format", "arrays", "-output", "-", input)
+	if result.stdout != `[["1","true","text"],["2.5","false","x"]]` {
+		t.Errorf("got %s without -typed", result.stdout)
+	}
+}
+
+func TestQuoteEmpty(t *testing.T) {
+	dir := t.TempDir()
+	// the second row is short, its b is missing rather than empty.
+	input := writeFile(t, dir, "data.csv", "a,b\n,x\n1\n")
+	for _, test := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-blank-as-null"}, `[[null,"x"],["1",null]]`},
+		{[]string{"-blank-as-null", "-quote-empty"}, `[["","x"],["1",null]]`},
+		{nil, `[["","x"],["1",null]]`},
+	} {
+		args := append([]string{"-quiet", "-format", "arrays", "-pad", "-null-for-missing", "-output", "-"}, test.args...)
+		result := convert(t, append(args, input)...)
+		if result.stdout != test.want {
+			t.Errorf("%v: got %s, want %s", test.args, result.stdout, test.want)
+		}
+	}
+}
+
+func TestCustomSchemaType(t *testing.T) {
+	// the type only exists on this conversion's inputFile, nothing shared
+	// is changed.
+	fileData := pipelineInput(t, 2)
+	cents := func(value string, _ inputFile) (interface{}, error) {
+		amount, err := strconv.ParseFloat(strings.TrimPrefix(value, "$"), 64)
+		if err != nil {
+			return nil, err
+		}
+		return int64(math.Round(amount * 100)), nil
+	}
+	if err := registerSchemaType(&fileData, "cents", cents); err != nil {
+		t.Fatal(err)
+	}
+	if err := registerSchemaType(&fileData, "cents", cents); err == nil || !strings.Contains(err.Error(), "Schema type cents is already registered") {
+		t.Errorf("got %v registering cents twice", err)
+	}
+	if err := registerSchemaType(&fileData, "int", cents); err == nil || !strings.Contains(err.Error(), "Schema type int is built in") {
+		t.Errorf("got %v replacing int", err)
+	}
+	schemaPath := writeFile(t, t.TempDir(), "schema.json", `{"amount":"cents"}`)
+	if _, err := loadSchema(schemaPath, inputFile{}); err == nil || !strings.Contains(err.Error(), "unknown type cents") {
+		t.Errorf("got %v without the type registered", err)
+	}
+	schema, err := loadSchema(schemaPath, fileData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileData.schema = schema
+	runPipeline(t, fileData)
+	var records []map[string]interface{}
+	decodeJSON(t, readFile(t, fileData.output), &records)
+	for i, record := range records {
+		if got, want := record["amount"], json.Number(strconv.Itoa(i*100+50)); got != want {
+			t.Errorf("record %d: got %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestKeepOrderAsMap(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "id,z,a\n1,x,y\n2,p,q\n")
+	convert(t, "-quiet", "-as-map", "id", "-keep-order", input)
+	if got, want := readFile(t, filepath.Join(dir, "data.json")), `{"1":{"id":"1","z":"x","a":"y"},"2":{"id":"2","z":"p","a":"q"}}`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	convert(t, "-quiet", "-as-map", "id", input)
+	if got, want := readFile(t, filepath.Join(dir, "data.json")), `{"1":{"a":"y","id":"1","z":"x"},"2":{"a":"q","id":"2","z":"p"}}`; got != want {
+		t.Errorf("got %s without -keep-order, want %s", got, want)
+	}
+}
+
+func TestSample(t *testing.T) {
+	dir := t.TempDir()
+	var data strings.Builder
+	data.WriteString("id\n")
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&data, "%d\n", i)
+	}
+	input := writeFile(t, dir, "data.csv", data.String())
+	sample := func(seed string) string {
+		t.Helper()
+		return convert(t, "-quiet", "-sample", "0.1", "-seed", seed, "-output", "-", input).stdout
+	}
+	first := sample("1")
+	if again := sample("1"); again != first {
+		t.Error("the same seed picked different rows")
+	}
+	var records []map[string]string
+	decodeJSON(t, first, &records)
+	// about one in ten, well within what chance allows for 1000 rows.
+	if len(records) < 60 || len(records) > 140 {
+		t.Errorf("got %d of 1000 rows", len(records))
+	}
+	if other := sample("2"); other == first {
+		t.Error("another seed picked the same rows")
+	}
+	if result := runTool(t, "-sample", "1.5", input); result.code != exitUsage {
+		t.Errorf("got exit %d for -sample 1.5", result.code)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "old.csv", "id,name,fax\n1,a,x\n")
+	other := writeFile(t, dir, "new.csv", "id,email,name,phone\n1,e,a,p\n")
+	result := convert(t, "-compare", other, input)
+	var diff headerDiff
+	if err := json.Unmarshal([]byte(result.stdout), &diff); err != nil {
+		t.Fatalf("%v: %s", err, result.stdout)
+	}
+	want := headerDiff{Input: input, Other: other, Added: []string{"email", "phone"}, Removed: []string{"fax"}}
+	if !reflect.DeepEqual(diff, want) {
+		t.Errorf("got %+v, want %+v", diff, want)
+	}
+	// nothing is converted.
+	if _, err := os.Stat(filepath.Join(dir, "old.json")); err == nil {
+		t.Error("-compare wrote a JSON file")
+	}
+}
+
+func TestURLOutputNameSanitised(t *testing.T) {
+	// %2F decodes to a /, only the part after it names the file, so the
+	// output can't point into another directory.
+	fileData := inputFile{filepath: "http://example.com/exports/a%2F..%2Fb.csv", format: "json"}
+	if got, want := getOutputPath(fileData, 0), "b.json"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	// a character some file system can't hold becomes _, in numbered pages
+	// too.
+	fileData = inputFile{filepath: "http://example.com/exports/a%3Ab.csv", format: "json", pageSize: 10}
+	if got, want := getOutputPath(fileData, 1), "a_b.001.json"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	for name, want := range map[string]string{
+		`a\b`:    "a_b",
+		"a:b":    "a_b",
+		"a*b":    "a_b",
+		"a?b":    "a_b",
+		`a"b`:    "a_b",
+		"a<b>":   "a_b_",
+		"a|b":    "a_b",
+		"a\x00b": "a_b",
+		"a\tb":   "a_b",
+		"a\x1fb": "a_b",
+		"a\x7fb": "a_b",
+		".":      "_",
+		"..":     "__",
+		"...":    "...",
+		"a.b":    "a.b",
+		"café":   "café",
+	} {
+		if got := safeFileName(name); got != want {
+			t.Errorf("%q: got %q, want %q", name, got, want)
+		}
+	}
+	// a URL path ending in .. names the output without pointing up.
+	fileData = inputFile{filepath: "http://example.com/exports/%2E%2E", format: "json"}
+	if got, want := getOutputPath(fileData, 0), "__.json"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestRequireColumns(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "id,created_at\n1,2024-01-01\n")
+	result := runTool(t, "-quiet", "-require-columns", "id, email ,created_at", input)
+	if result.code != exitParse || !strings.Contains(result.stderr, "Required columns missing from the header: email") {
+		t.Errorf("got exit %d: %s", result.code, result.stderr)
+	}
+	// the check comes before anything is converted.
+	if _, err := os.Stat(filepath.Join(dir, "data.json")); err == nil {
+		t.Error("a JSON file was written")
+	}
+	convert(t, "-quiet", "-require-columns", "id,created_at", input)
+}
+
+func TestIndexBy(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "id,name\n1,a\n22,bb\n333,\"c, c\"\n")
+	convert(t, "-quiet", "-format", "ndjson", "-index-by", "id", input)
+	data := readFile(t, filepath.Join(dir, "data.ndjson"))
+	var offsets map[string]int
+	decodeJSON(t, readFile(t, filepath.Join(dir, "data.ndjson.idx")), &offsets)
+	if len(offsets) != 3 {
+		t.Fatalf("got %v", offsets)
+	}
+	// each offset is the start of the line holding that record.
+	for id, offset := range offsets {
+		line, _, _ := strings.Cut(data[offset:], "\n")
+		var record map[string]string
+		decodeJSON(t, line, &record)
+		if record["id"] != id {
+			t.Errorf("offset %d of %s points to %s", offset, id, line)
+		}
+	}
+	input = writeFile(t, dir, "data.csv", "id\n1\n1\n")
+	if result := runTool(t, "-quiet", "-format", "ndjson", "-index-by", "id", input); result.code == 0 || !strings.Contains(result.stderr, "Key 1 appears more than once in column id") {
+		t.Errorf("got exit %d for a repeated key: %s", result.code, result.stderr)
+	}
+}
+
+func TestAddTimestamp(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "id\n1\n2\n")
+	before := time.Now().Add(-time.Second)
+	convert(t, "-quiet", "-add-timestamp", "__converted_at", input)
+	records := readRecords(t, filepath.Join(dir, "data.json"))
+	for _, record := range records {
+		stamp, err := time.Parse(time.RFC3339, fmt.Sprint(record["__converted_at"]))
+		if err != nil || stamp.Before(before.Truncate(time.Second)) || stamp.After(time.Now()) {
+			t.Errorf("got %v: %v", record["__converted_at"], err)
+		}
+	}
+	// one run has one time.
+	if len(records) != 2 || records[0]["__converted_at"] != records[1]["__converted_at"] {
+		t.Errorf("got %v", records)
+	}
+	result := runTool(t, "-quiet", "-add-timestamp", "id", input)
+	if result.code != exitParse || !strings.Contains(result.stderr, "Timestamp key id is already a column in the header") {
+		t.Errorf("got exit %d: %s", result.code, result.stderr)
+	}
+}
+
+func TestEnvironmentDefaults(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "a;b\n1;2\n")
+	env := []string{"CSV2JSON_SEPARATOR=semicolon", "CSV2JSON_PRETTY=true"}
+	result := runToolEnv(t, env, "", "-quiet", "-output", "-", input)
+	if want := "[\n  {\n    \"a\": \"1\",\n    \"b\": \"2\"\n  }\n]"; result.code != 0 || result.stdout != want {
+		t.Errorf("got exit %d, %q: %s", result.code, result.stdout, result.stderr)
+	}
+	// a flag wins over the variable.
+	result = runToolEnv(t, env, "", "-quiet", "-pretty=false", "-output", "-", input)
+	if result.code != 0 || result.stdout != `[{"a":"1","b":"2"}]` {
+		t.Errorf("got exit %d, %q: %s", result.code, result.stdout, result.stderr)
+	}
+	result = runToolEnv(t, []string{"CSV2JSON_PRETTY=maybe"}, "", "-quiet", input)
+	if result.code != exitUsage || !strings.Contains(result.stderr, "Environment variable CSV2JSON_PRETTY") {
+		t.Errorf("got exit %d: %s", result.code, result.stderr)
+	}
+}
+
+func TestExactNumbers(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "n,f,e\n5,5.0,1.50e3\n")
+	convert(t, "-quiet", "-typed", "-exact-numbers", input)
+	if got := readFile(t, filepath.Join(dir, "data.json")); got != `[{"e":1.50e3,"f":5.0,"n":5}]` {
+		t.Errorf("got %s", got)
+	}
+	// without it a whole number still has no decimal point.
+	convert(t, "-quiet", "-typed", input)
+	if got := readFile(t, filepath.Join(dir, "data.json")); got != `[{"e":1500,"f":5,"n":5}]` {
+		t.Errorf("got %s without -exact-numbers", got)
+	}
+}
+
+func TestZipArchive(t *testing.T) {
+	dir := t.TempDir()
+	var archive bytes.Buffer
+	writer := zip.NewWriter(&archive)
+	for _, entry := range []struct{ name, content string }{
+		{"a.csv", "id\n1\n"},
+		{"broken.csv", ""},
+		{"../evil.csv", "id\n2\n"},
+		{"sub/c.csv", "id\n3\n"},
+	} {
+		file, err := writer.Create(entry.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(file, entry.content)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	input := writeFile(t, dir, "data.zip", archive.String())
+	result := runTool(t, "-quiet", input)
+	// the failing entries don't stop the others.
+	if result.code != 1 || !strings.Contains(result.stderr, "2 of 4 files failed: ../evil.csv, broken.csv") {
+		t.Errorf("got exit %d: %s", result.code, result.stderr)
+	}
+	if !strings.Contains(result.stderr, "Archive entry ../evil.csv points outside the archive") {
+		t.Errorf("the entry outside the archive wasn't reported: %s", result.stderr)
+	}
+	if got := readFile(t, filepath.Join(dir, "data", "a.json")); got != `[{"id":"1"}]` {
+		t.Errorf("got %s for a.csv", got)
+	}
+	if got := readFile(t, filepath.Join(dir, "data", "sub", "c.json")); got != `[{"id":"3"}]` {
+		t.Errorf("got %s for sub/c.csv", got)
+	}
+	for _, path := range []string{filepath.Join(dir, "evil.json"), filepath.Join(dir, "evil.csv")} {
+		if _, err := os.Stat(path); err == nil {
+			t.Errorf("%s was written outside the output directory", path)
+		}
+	}
+}
+
+func TestKeyCase(t *testing.T) {
+	dir := t.TempDir()
+	input := writeFile(t, dir, "data.csv", "Order ID,first_name,last-name\n1,a,b\n")
+	for keyCase, want := range map[string]string{
+		"camel": `[{"firstName":"a","lastName":"b","orderId":"1"}]`,
+		"snake": `[{"first_name":"a","last_name":"b","order_id":"1"}]`,
+		"kebab": `[{"first-name":"a","last-name":"b","order-id":"1"}]`,
+	} {
+		convert(t, "-quiet", "-key-case", keyCase, input)
+		if got := readFile(t, filepath.Join(dir, "data.json")); got != want {
+			t.Errorf("%s: got %s, want %s", keyCase, got, want)
+		}
+	}
+	input = writeFile(t, dir, "data.csv", "a_b,aB\n1,2\n")
+	result := runTool(t, "-quiet", "-key-case", "camel", input)
+	if result.code != exitParse || !strings.Contains(result.stderr, "Headers a_b and aB both become aB after -key-case camel") {
+		t.Errorf("got exit %d: %s", result.code, result.stderr)
+	}
+	if result := runTool(t, "-key-case", "pascal", input); result.code != exitUsage {
+		t.Errorf("got exit %d for pascal", result.code)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func nestRecord(record map[string]interface{}, fileData inputFile) (map[string]interface{}, error) {
+	// dotted keys such as address.city become nested objects, the opposite
+	// of -flatten. Keys are taken in sorted order so a value always comes
+	// before the keys nested under it, under -nest-conflict=overwrite the
+	// nested object replaces that value, otherwise it's an error.
+	keys := make([]string, 0, len(record))
+	for key := range record {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	nested := make(map[string]interface{})
+	for _, key := range keys {
+		parts := strings.Split(key, ".")
+		node := nested
+		for i, part := range parts[:len(parts)-1] {
+			child, isObject := node[part].(map[string]interface{})
+			if !isObject {
+				if _, taken := node[part]; taken && fileData.nestConflict == "error" {
+					return nil, fmt.Errorf("Column %s is both a value and a parent of %s", strings.Join(parts[:i+1], "."), key)
+				}
+				child = make(map[string]interface{})
+				node[part] = child
+			}
+			node = child
+		}
+		node[parts[len(parts)-1]] = nestedLeaf(record[key])
+	}
+	nestArrays(nested)
+	return nested, nil
+}
+
+func nestConflict(columns []string) error {
+	// the conflict nestRecord would find, from the column names alone so a
+	// header that has one fails before any output is made.
+	sorted := append([]string(nil), columns...)
+	sort.Strings(sorted)
+	for _, key := range sorted {
+		parts := strings.Split(key, ".")
+		for i := 1; i < len(parts); i++ {
+			if parent := strings.Join(parts[:i], "."); contains(columns, parent) {
+				return fmt.Errorf("Column %s is both a value and a parent of %s", parent, key)
+			}
+		}
+	}
+	return nil
+}
+
+func nestedLeaf(value interface{}) interface{} {
+	// -flatten writes an empty object or array as {} or [], they are read
+	// back as the empty value rather than as text.
+	switch value {
+	case "{}":
+		return map[string]interface{}{}
+	case "[]":
+		return []interface{}{}
+	}
+	return value
+}
+
+func nestArrays(node map[string]interface{}) {
+	// an object whose keys are exactly 0 to n-1, such as tags.0 and tags.1,
+	// was an array before -flatten and becomes one again. The record itself
+	// always stays an object.
+	for key, child := range node {
+		if object, isObject := child.(map[string]interface{}); isObject {
+			nestArrays(object)
+			if array, ok := asArray(object); ok {
+				node[key] = array
+			}
+		}
+	}
+}
+
+func asArray(node map[string]interface{}) ([]interface{}, bool) {
+	if len(node) == 0 {
+		return nil, false
+	}
+	array := make([]interface{}, len(node))
+	for key, child := range node {
+		i, err := strconv.Atoi(key)
+		if err != nil || !isIndex(key) || i >= len(node) {
+			return nil, false
+		}
+		array[i] = child
+	}
+	return array, true
+}
+
+func topLevelKeys(columns []string) []string {
+	// the -columns-file order for nested records, each first part of a
+	// dotted name in the order it is first seen.
+	if columns == nil {
+		return nil
+	}
+	var keys []string
+	for _, column := range columns {
+		key := strings.SplitN(column, ".", 2)[0]
+		if !contains(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
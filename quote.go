@@ -0,0 +1,37 @@
+package main
+
+import "io"
+
+type quoteSwapper struct {
+	// encoding/csv only knows the double quote, so the -quote character and
+	// the double quote trade places on the way in. swapQuotes puts them back
+	// in the parsed values.
+	reader io.Reader
+	quote  byte
+}
+
+func (s *quoteSwapper) Read(p []byte) (int, error) {
+	n, err := s.reader.Read(p)
+	for i := 0; i < n; i++ {
+		if p[i] == s.quote {
+			p[i] = '"'
+		} else if p[i] == '"' {
+			p[i] = s.quote
+		}
+	}
+	return n, err
+}
+
+func swapQuotes(fields []string, quote byte) {
+	for i, field := range fields {
+		swapped := []byte(field)
+		for j, b := range swapped {
+			if b == quote {
+				swapped[j] = '"'
+			} else if b == '"' {
+				swapped[j] = quote
+			}
+		}
+		fields[i] = string(swapped)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+type headerRename struct {
+	// one -rename-regex, a sed style s/pattern/replacement/ with an optional
+	// g to replace every match rather than the first.
+	pattern     *regexp.Regexp
+	replacement string
+	global      bool
+}
+
+// sed style \1 group references, written as ${1} for regexp.
+var sedGroup = regexp.MustCompile(`\\(\d)`)
+
+func parseRename(spec string) (headerRename, error) {
+	// the character after the s is the delimiter, so s|/|_|g works too.
+	if len(spec) < 2 || spec[0] != 's' {
+		return headerRename{}, fmt.Errorf("-rename-regex %s must be in the form s/pattern/replacement/", spec)
+	}
+	parts := strings.Split(spec[2:], spec[1:2])
+	if len(parts) != 3 || (parts[2] != "" && parts[2] != "g") {
+		return headerRename{}, fmt.Errorf("-rename-regex %s must be in the form s/pattern/replacement/ with an optional g", spec)
+	}
+	pattern, err := regexp.Compile(parts[0])
+	if err != nil {
+		return headerRename{}, fmt.Errorf("-rename-regex %s has an invalid pattern: %v", spec, err)
+	}
+	replacement := sedGroup.ReplaceAllString(parts[1], "$${$1}")
+	return headerRename{pattern, replacement, parts[2] == "g"}, nil
+}
+
+func (r headerRename) apply(name string) string {
+	if r.global {
+		return r.pattern.ReplaceAllString(name, r.replacement)
+	}
+	match := r.pattern.FindStringSubmatchIndex(name)
+	if match == nil {
+		return name
+	}
+	replaced := r.pattern.ExpandString(nil, r.replacement, name, match)
+	return name[:match[0]] + string(replaced) + name[match[1]:]
+}
+
+func renameHeaders(headers []string, renames []headerRename) error {
+	// the renames run in the order given on every header name, two headers
+	// that end up with the same name can't both be kept.
+	seen := make(map[string]string)
+	for i, original := range headers {
+		name := original
+		for _, rename := range renames {
+			name = rename.apply(name)
+		}
+		if name == "" {
+			return fmt.Errorf("Header %s is empty after -rename-regex", original)
+		}
+		if other, taken := seen[name]; taken {
+			return fmt.Errorf("Headers %s and %s both become %s after -rename-regex", other, original, name)
+		}
+		seen[name] = original
+		headers[i] = name
+	}
+	return nil
+}
+
+func keyWords(name string) []string {
+	// words are split at anything that isn't a letter or digit and where a
+	// lower case letter or digit is followed by an upper case one, so
+	// "Order ID", "orderId" and "order_id" all give order and id. A run of
+	// capitals ends before the capital that starts the next word, as in
+	// HTTPStatus.
+	var words []string
+	var word []rune
+	runes := []rune(name)
+	for i, r := range runes {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			if word != nil {
+				words = append(words, string(word))
+				word = nil
+			}
+			continue
+		}
+		if word != nil && unicode.IsUpper(r) {
+			previous := word[len(word)-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if !unicode.IsUpper(previous) || nextLower {
+				words = append(words, string(word))
+				word = nil
+			}
+		}
+		word = append(word, r)
+	}
+	if word != nil {
+		words = append(words, string(word))
+	}
+	return words
+}
+
+func keyCase(name string, style string) string {
+	words := keyWords(name)
+	for i, word := range words {
+		word = strings.ToLower(word)
+		if style == "camel" && i > 0 {
+			first, size := utf8.DecodeRuneInString(word)
+			word = string(unicode.ToUpper(first)) + word[size:]
+		}
+		words[i] = word
+	}
+	switch style {
+	case "snake":
+		return strings.Join(words, "_")
+	case "kebab":
+		return strings.Join(words, "-")
+	}
+	return strings.Join(words, "")
+}
+
+func caseHeaders(headers []string, style string) error {
+	// the same rules as -rename-regex, every header needs a name of its own.
+	seen := make(map[string]string)
+	for i, original := range headers {
+		name := keyCase(original, style)
+		if name == "" {
+			return fmt.Errorf("Header %s is empty after -key-case %s", original, style)
+		}
+		if other, taken := seen[name]; taken {
+			return fmt.Errorf("Headers %s and %s both become %s after -key-case %s", other, original, name, style)
+		}
+		seen[name] = original
+		headers[i] = name
+	}
+	return nil
+}
+
+func normalizeHeaders(headers []string) error {
+	// two headers that only differed in how a character was encoded are the
+	// same name afterwards, which can't both be kept.
+	seen := make(map[string]string)
+	for i, original := range headers {
+		name := norm.NFC.String(original)
+		if other, taken := seen[name]; taken {
+			return fmt.Errorf("Headers %q and %q are the same after -normalize-headers", other, original)
+		}
+		seen[name] = original
+		headers[i] = name
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func readJSONRecords(jsonPath string, gzipped bool) ([]map[string]interface{}, error) {
+	// the input must be an array of objects, numbers are kept as written.
+	var input io.Reader = os.Stdin
+	if jsonPath != stdioPath {
+		file, err := os.Open(jsonPath)
+		if err != nil {
+			return nil, withExitCode(exitNotFound, err)
+		}
+		defer file.Close()
+		input = file
+	}
+	if gzipped {
+		gzipReader, err := gzip.NewReader(input)
+		if err != nil {
+			return nil, withExitCode(exitParse, fmt.Errorf("File %s is not gzip compressed: %v", jsonPath, err))
+		}
+		defer gzipReader.Close()
+		input = gzipReader
+	}
+
+	decoder := json.NewDecoder(input)
+	decoder.UseNumber()
+	var records []map[string]interface{}
+	if err := decoder.Decode(&records); err != nil {
+		return nil, withExitCode(exitParse, fmt.Errorf("File %s is not a JSON array of objects: %v", jsonPath, err))
+	}
+	return records, nil
+}
+
+func flattenValue(prefix string, value interface{}, flat map[string]interface{}) {
+	// nested objects become dotted keys and arrays are indexed, so
+	// {"address":{"city":"x"},"tags":["a"]} gives address.city and tags.0.
+	// An empty object or array has no keys to give, so it stays a column of
+	// its own written as {} or [].
+	switch nested := value.(type) {
+	case map[string]interface{}:
+		if len(nested) == 0 {
+			flat[prefix] = value
+		}
+		for key, child := range nested {
+			flattenValue(prefix+"."+key, child, flat)
+		}
+	case []interface{}:
+		if len(nested) == 0 {
+			flat[prefix] = value
+		}
+		for i, child := range nested {
+			flattenValue(prefix+"."+strconv.Itoa(i), child, flat)
+		}
+	default:
+		flat[prefix] = value
+	}
+}
+
+func isIndex(part string) bool {
+	// an array index as flattenValue writes it, without leading zeros.
+	if part == "" || (len(part) > 1 && part[0] == '0') {
+		return false
+	}
+	for _, r := range part {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func lessFlattened(a string, b string) bool {
+	// dotted columns are compared part by part, with array indexes as
+	// numbers so tags.2 comes before tags.10.
+	aParts, bParts := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(aParts) && i < len(bParts); i++ {
+		if aParts[i] == bParts[i] {
+			continue
+		}
+		if isIndex(aParts[i]) && isIndex(bParts[i]) && len(aParts[i]) != len(bParts[i]) {
+			return len(aParts[i]) < len(bParts[i])
+		}
+		return aParts[i] < bParts[i]
+	}
+	return len(aParts) < len(bParts)
+}
+
+func flattenRecord(record map[string]interface{}) map[string]interface{} {
+	flat := make(map[string]interface{})
+	for key, value := range record {
+		flattenValue(key, value, flat)
+	}
+	return flat
+}
+
+func csvValue(value interface{}) string {
+	// scalars are written as plain text, anything still nested is written as
+	// its JSON so no data is lost.
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		jsonData, _ := json.Marshal(v)
+		return string(jsonData)
+	}
+}
+
+func getCsvOutputPath(fileData inputFile) string {
+	if fileData.output != "" {
+		return fileData.output
+	}
+	jsonPath := fileData.filepath
+	jsonDir := inputDir(jsonPath)
+	csvName := fmt.Sprintf("%s.csv", trimExtension(trimExtension(filepath.Base(jsonPath), ".gz"), ".json"))
+	return filepath.Join(jsonDir, csvName)
+}
+
+func writeCsvFile(fileData inputFile, report *conversionReport) error {
+	// reverse mode, turn a JSON array of objects back into a CSV file.
+	records, err := readJSONRecords(fileData.filepath, fileData.gzipIn || hasExtension(fileData.filepath, ".gz"))
+	if err != nil {
+		return err
+	}
+	if fileData.flatten {
+		for i, record := range records {
+			records[i] = flattenRecord(record)
+		}
+	}
+
+	// the columns are every key seen in any object, or with
+	// -columns-from-first only the first object's, in sorted order to match
+	// the key order of the JSON output, with the elements of a flattened
+	// array in index order. missing keys are written empty.
+	columnSource := records
+	if fileData.firstColumns && len(records) > 0 {
+		columnSource = records[:1]
+	}
+	seen := make(map[string]bool)
+	var headers []string
+	for _, record := range columnSource {
+		for key := range record {
+			if !seen[key] {
+				seen[key] = true
+				headers = append(headers, key)
+			}
+		}
+	}
+	if fileData.flatten {
+		sort.Slice(headers, func(i, j int) bool { return lessFlattened(headers[i], headers[j]) })
+	} else {
+		sort.Strings(headers)
+	}
+	report.Columns = headers
+
+	printStatus(fileData, "Writing CSV file...\n")
+
+	var f io.WriteCloser = nopWriteCloser{os.Stdout}
+	if csvPath := getCsvOutputPath(fileData); csvPath != stdioPath {
+		file, err := os.Create(csvPath)
+		if err != nil {
+			return withExitCode(exitWrite, writeFailure(csvPath, err))
+		}
+		f = file
+	}
+	defer f.Close()
+	writer := csv.NewWriter(f)
+	writer.Comma = fileData.outComma
+
+	if err := writer.Write(headers); err != nil {
+		return withExitCode(exitWrite, err)
+	}
+	line := make([]string, len(headers))
+	for _, record := range records {
+		report.RowsRead++
+		for i, name := range headers {
+			line[i] = csvValue(record[name])
+		}
+		if err := writer.Write(line); err != nil {
+			return withExitCode(exitWrite, err)
+		}
+		report.RowsWritten++
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return withExitCode(exitWrite, err)
+	}
+	if err := f.Close(); err != nil {
+		return withExitCode(exitWrite, err)
+	}
+
+	printStatus(fileData, "Completed!\n")
+	return nil
+}
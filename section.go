@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+type blockReader struct {
+	// passes lines through until the first blank one, which ends the block.
+	input   *bufio.Reader
+	pending []byte
+	err     error
+}
+
+func (r *blockReader) Read(p []byte) (int, error) {
+	if len(r.pending) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		line, err := r.input.ReadBytes('\n')
+		if err != nil {
+			r.err = err
+		}
+		if len(line) > 0 && strings.TrimSpace(string(line)) == "" {
+			r.err = io.EOF
+			return 0, io.EOF
+		}
+		if len(line) == 0 {
+			return 0, r.err
+		}
+		r.pending = line
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func skipToSection(input *bufio.Reader, section int) (*bufio.Reader, int64, int, error) {
+	// sections are blocks of lines split by one or more blank lines, each
+	// with its own header. Everything before block number section is
+	// skipped and the reader that comes back ends with that block. A blank
+	// line inside a quoted value ends a block too. The skipped bytes and
+	// lines are returned so offsets and line numbers can be put right.
+	var skipped int64
+	lines := 0
+	current := 0
+	inBlock := false
+	for {
+		text, err := input.ReadString('\n')
+		blank := strings.TrimSpace(text) == ""
+		if !blank && !inBlock {
+			current++
+		}
+		inBlock = !blank
+		if current == section {
+			rest := bufio.NewReader(io.MultiReader(strings.NewReader(text), input))
+			return bufio.NewReaderSize(&blockReader{input: rest}, 64*1024), skipped, lines, nil
+		}
+		if err == io.EOF {
+			return nil, 0, 0, fmt.Errorf("Section %d not found, the file has %d", section, current)
+		}
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		skipped += int64(len(text))
+		lines++
+	}
+}
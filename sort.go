@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type sortKey struct {
+	// a -sort-by column and whether it sorts high to low
+	column     string
+	descending bool
+}
+
+func parseSortKeys(sortBy string) ([]sortKey, error) {
+	// "lastname:desc,firstname" sorts by lastname high to low, then by
+	// firstname low to high.
+	if sortBy == "" {
+		return nil, nil
+	}
+	var keys []sortKey
+	for _, entry := range strings.Split(sortBy, ",") {
+		column, direction, _ := strings.Cut(entry, ":")
+		if column == "" {
+			return nil, fmt.Errorf("-sort-by entry %s has no column", entry)
+		}
+		switch direction {
+		case "", "asc":
+			keys = append(keys, sortKey{column, false})
+		case "desc":
+			keys = append(keys, sortKey{column, true})
+		default:
+			return nil, fmt.Errorf("-sort-by direction %s must be asc or desc", direction)
+		}
+	}
+	return keys, nil
+}
+
+func numericValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case json.Number:
+		number, err := strconv.ParseFloat(v.String(), 64)
+		return number, err == nil
+	}
+	return 0, false
+}
+
+func compareValues(a interface{}, b interface{}) int {
+	// nulls sort first, numbers compare as numbers and everything else
+	// compares as text.
+	if a == nil || b == nil {
+		switch {
+		case a == nil && b == nil:
+			return 0
+		case a == nil:
+			return -1
+		default:
+			return 1
+		}
+	}
+	if x, ok := numericValue(a); ok {
+		if y, ok := numericValue(b); ok {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+func sortRecords(keys []sortKey, in <-chan map[string]interface{}, out chan<- map[string]interface{}) {
+	// every record is held until the input ends, then sent on in -sort-by
+	// order. The sort is stable so ties keep their input order.
+	var records []map[string]interface{}
+	for record := range in {
+		records = append(records, record)
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		for _, key := range keys {
+			order := compareValues(records[i][key.column], records[j][key.column])
+			if order == 0 {
+				continue
+			}
+			if key.descending {
+				return order > 0
+			}
+			return order < 0
+		}
+		return false
+	})
+	for _, record := range records {
+		out <- record
+	}
+	close(out)
+}
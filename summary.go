@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+type columnSummary struct {
+	// what -summary knows about a column, from the values as they were read.
+	name     string
+	nonEmpty int
+	kind     string
+}
+
+func (s *columnSummary) add(value string, fileData inputFile) {
+	if value == "" {
+		return
+	}
+	s.nonEmpty++
+	s.kind = mergeKind(s.kind, valueKind(value, fileData))
+}
+
+func printSummary(out io.Writer, summaries []columnSummary, rows int) error {
+	// one line per column, a column with no values at all has no type.
+	table := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(table, "column\tnon-empty\ttype\n")
+	for _, summary := range summaries {
+		kind := summary.kind
+		if kind == "" {
+			kind = "-"
+		}
+		fmt.Fprintf(table, "%s\t%d/%d\t%s\n", summary.name, summary.nonEmpty, rows, kind)
+	}
+	return table.Flush()
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a function that turns a non-empty cell into a value of one -schema-file
+// type.
+type schemaCoercer func(value string, fileData inputFile) (interface{}, error)
+
+// the built-in column types that can be given in a -schema-file and the
+// function for each of them. Other types are registered on the inputFile
+// of a conversion with registerSchemaType.
+var schemaTypes = map[string]schemaCoercer{
+	"int": func(value string, fileData inputFile) (interface{}, error) {
+		return parseIntValue(value, fileData)
+	},
+	"float": func(value string, fileData inputFile) (interface{}, error) {
+		// a value past the float64 range, e.g. 1e999, reads as an infinity
+		// and follows -nonfinite like Inf does.
+		number, err := parseFloatValue(value, fileData)
+		if errors.Is(err, strconv.ErrRange) && math.IsInf(number, 0) {
+			return number, nil
+		}
+		return number, err
+	},
+	"bool": func(value string, _ inputFile) (interface{}, error) {
+		return strconv.ParseBool(value)
+	},
+	"string": func(value string, _ inputFile) (interface{}, error) {
+		return value, nil
+	},
+	"date": func(value string, fileData inputFile) (interface{}, error) {
+		// -date-layout values are tried before the ISO formats.
+		layouts := append(append([]string{}, fileData.dateLayout...), "2006-01-02", time.RFC3339)
+		if date, ok := parseDate(value, layouts); ok {
+			return date, nil
+		}
+		return nil, fmt.Errorf("no date layout matches %s", value)
+	},
+}
+
+// returned under -nonfinite=error for a NaN or infinity in a float column.
+var errNonFinite = errors.New("not a finite number")
+
+// the -float-fmt verbs that always give a valid JSON number.
+var floatFormat = regexp.MustCompile(`^%(\.\d+)?[efg]$`)
+
+// number text that JSON takes as it is, strconv also reads forms such as
+// +5, .5 or 0x1p2 which JSON doesn't.
+var jsonNumber = regexp.MustCompile(`^-?(0|[1-9]\d*)(\.\d+)?([eE][+-]?\d+)?$`)
+
+func registerSchemaType(fileData *inputFile, name string, coerce schemaCoercer) error {
+	// a type of the program's own, such as a currency or an enum, for the
+	// schema of this conversion only. Built-in types can't be replaced and a
+	// name can only be registered once.
+	if name == "" || coerce == nil {
+		return errors.New("A schema type needs a name and a function")
+	}
+	if _, builtIn := schemaTypes[name]; builtIn {
+		return fmt.Errorf("Schema type %s is built in and can't be registered", name)
+	}
+	if _, taken := fileData.schemaTypes[name]; taken {
+		return fmt.Errorf("Schema type %s is already registered", name)
+	}
+	if fileData.schemaTypes == nil {
+		fileData.schemaTypes = make(map[string]schemaCoercer)
+	}
+	fileData.schemaTypes[name] = coerce
+	return nil
+}
+
+func lookupSchemaType(kind string, fileData inputFile) schemaCoercer {
+	if coerce, builtIn := schemaTypes[kind]; builtIn {
+		return coerce
+	}
+	return fileData.schemaTypes[kind]
+}
+
+func loadSchema(schemaPath string, fileData inputFile) (map[string]string, error) {
+	// schema file is a JSON object mapping column names to types.
+	schemaData, err := os.ReadFile(schemaPath)
+	if err != nil {
+		return nil, err
+	}
+	schema := make(map[string]string)
+	if err := json.Unmarshal(schemaData, &schema); err != nil {
+		return nil, fmt.Errorf("Schema file %s is not a JSON object of column types: %v", schemaPath, err)
+	}
+	for column, kind := range schema {
+		if lookupSchemaType(kind, fileData) == nil {
+			return nil, fmt.Errorf("Column %s has unknown type %s, allowed are int, float, bool, string or date", column, kind)
+		}
+	}
+	return schema, nil
+}
+
+func coerceValue(value string, kind string, fileData inputFile) (interface{}, error) {
+	// strings are left alone, an empty cell in a typed column becomes null.
+	if kind == "string" {
+		return value, nil
+	}
+	if value == "" {
+		return nil, nil
+	}
+	return lookupSchemaType(kind, fileData)(value, fileData)
+}
+
+// a number written with a decimal comma and optional dots between the
+// thousands, e.g. 1.234,56 or 12,5.
+var decimalCommaNumber = regexp.MustCompile(`^[+-]?(\d{1,3}(\.\d{3})+|\d+)(,\d+)?$`)
+
+func numberText(value string, fileData inputFile) (string, error) {
+	// under -decimal-comma numbers are turned into the form strconv reads,
+	// anything else isn't a number at all.
+	if !fileData.decimalComma {
+		return value, nil
+	}
+	if !decimalCommaNumber.MatchString(value) {
+		return "", fmt.Errorf("%s is not a decimal comma number", value)
+	}
+	return strings.Replace(strings.ReplaceAll(value, ".", ""), ",", ".", 1), nil
+}
+
+func parseIntValue(value string, fileData inputFile) (int64, error) {
+	text, err := numberText(value, fileData)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(text, 10, 64)
+}
+
+func parseFloatValue(value string, fileData inputFile) (float64, error) {
+	text, err := numberText(value, fileData)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(text, 64)
+}
+
+func matchesToken(value string, tokens []string, ignoreCase bool) bool {
+	for _, token := range tokens {
+		if value == token || (ignoreCase && strings.EqualFold(value, token)) {
+			return true
+		}
+	}
+	return false
+}
+
+func inferValue(value string, fileData inputFile) interface{} {
+	// booleans come from the -bool-true and -bool-false vocabularies and are
+	// checked first so tokens like 1 or 0 can be booleans, then -date-layout
+	// dates, whole numbers and floats. Anything else, including empty cells,
+	// stays a string.
+	if value == "" {
+		return value
+	}
+	if matchesToken(value, fileData.boolTrue, fileData.boolFold) {
+		return true
+	}
+	if matchesToken(value, fileData.boolFalse, fileData.boolFold) {
+		return false
+	}
+	if date, ok := parseDate(value, fileData.dateLayout); ok {
+		return date
+	}
+	if number, ok := inferNumber(value, fileData); ok {
+		return number
+	}
+	return value
+}
+
+func inferNumber(value string, fileData inputFile) (interface{}, bool) {
+	// only text that is already a JSON number, after -decimal-comma, is
+	// taken as one. strconv also reads words such as Nan or inf and forms
+	// such as 1_0 or 0x1p2, which are left as strings.
+	text, err := numberText(value, fileData)
+	if err != nil || !jsonNumber.MatchString(text) {
+		return nil, false
+	}
+	if number, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return number, true
+	}
+	if number, err := strconv.ParseFloat(text, 64); err == nil {
+		return number, true
+	}
+	return nil, false
+}
+
+func parseDate(value string, layouts []string) (string, bool) {
+	// dates are normalised to ISO 8601, a value without a time of day is
+	// written as just the date.
+	for _, layout := range layouts {
+		date, err := time.Parse(layout, value)
+		if err != nil {
+			continue
+		}
+		if date.Hour() == 0 && date.Minute() == 0 && date.Second() == 0 && date.Nanosecond() == 0 && date.Location() == time.UTC {
+			return date.Format("2006-01-02"), true
+		}
+		return date.Format(time.RFC3339), true
+	}
+	return "", false
+}
+
+func formatFloat(value interface{}, text string, fileData inputFile) (interface{}, error) {
+	// floats are written with -float-fmt when it is set, or with the digits
+	// of the text they came from under -exact-numbers, as a json.Number so
+	// the encoder writes them exactly. JSON has no NaN or infinity, which
+	// only a schema float column reads, so those follow -nonfinite instead.
+	number, isFloat := value.(float64)
+	if !isFloat {
+		return value, nil
+	}
+	if math.IsNaN(number) || math.IsInf(number, 0) {
+		switch fileData.nonFinite {
+		case "string":
+			return strconv.FormatFloat(number, 'g', -1, 64), nil
+		case "error":
+			return nil, errNonFinite
+		}
+		return nil, nil
+	}
+	if fileData.exactNumbers {
+		if exact, err := numberText(text, fileData); err == nil && jsonNumber.MatchString(exact) {
+			return json.Number(exact), nil
+		}
+	}
+	if fileData.floatFmt == "" {
+		return value, nil
+	}
+	return json.Number(fmt.Sprintf(fileData.floatFmt, number)), nil
+}
+
+func valueKind(value string, fileData inputFile) string {
+	// the same order as inferValue, giving the type name instead of the value.
+	if matchesToken(value, fileData.boolTrue, fileData.boolFold) || matchesToken(value, fileData.boolFalse, fileData.boolFold) {
+		return "bool"
+	}
+	if _, ok := parseDate(value, fileData.dateLayout); ok {
+		return "date"
+	}
+	switch number, _ := inferNumber(value, fileData); number.(type) {
+	case int64:
+		return "int"
+	case float64:
+		return "float"
+	}
+	return "string"
+}
+
+func mergeKind(kind string, next string) string {
+	// the type of a column so far and the type of its next value, a mix of
+	// whole numbers and floats is float and any other mix is string.
+	switch {
+	case kind == "" || kind == next:
+		return next
+	case (kind == "int" && next == "float") || (kind == "float" && next == "int"):
+		return "float"
+	}
+	return "string"
+}
+
+func inferColumnKinds(headers []string, records []map[string]interface{}, fileData inputFile) map[string]string {
+	// a column gets a type only when every non-empty value has it, a mix of
+	// whole numbers and floats is float and any other mix stays string.
+	// Schema columns are already typed and are left out.
+	kinds := make(map[string]string)
+	for _, name := range headers {
+		if _, typed := fileData.schema[name]; typed {
+			continue
+		}
+		kind := ""
+		for _, record := range records {
+			value, _ := record[name].(string)
+			if value == "" {
+				continue
+			}
+			kind = mergeKind(kind, valueKind(value, fileData))
+			if kind == "string" {
+				break
+			}
+		}
+		if kind != "" && kind != "string" {
+			kinds[name] = kind
+		}
+	}
+	return kinds
+}
+
+func applyColumnKinds(record map[string]interface{}, kinds map[string]string, fileData inputFile) (map[string]interface{}, error) {
+	// convert the buffered string values once the column types are known,
+	// an empty cell in a typed column becomes null.
+	for name, kind := range kinds {
+		raw, present := record[name]
+		if !present {
+			continue
+		}
+		value, _ := raw.(string)
+		if value == "" {
+			record[name] = nil
+			continue
+		}
+		var typedValue interface{} = value
+		switch kind {
+		case "bool":
+			typedValue = matchesToken(value, fileData.boolTrue, fileData.boolFold)
+		case "date":
+			typedValue, _ = parseDate(value, fileData.dateLayout)
+		case "int":
+			typedValue, _ = parseIntValue(value, fileData)
+		case "float":
+			typedValue, _ = parseFloatValue(value, fileData)
+		}
+		formatted, err := formatFloat(typedValue, value, fileData)
+		if err != nil {
+			return nil, fmt.Errorf("Column %s value %q is %w", name, value, err)
+		}
+		record[name] = formatted
+	}
+	return record, nil
+}
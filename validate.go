@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+type validatingWriter struct {
+	// holds a whole output file in memory, it is only created once the JSON
+	// has been checked.
+	bytes.Buffer
+	path     string
+	fileData inputFile
+}
+
+func (w *validatingWriter) Close() error {
+	if err := validJSON(w.Bytes(), w.fileData.format == "concat" || w.fileData.format == "ndjson" || w.fileData.chunkArray > 0); err != nil {
+		return fmt.Errorf("Output for %s is not valid JSON, nothing was written: %v", w.path, err)
+	}
+	out, err := createOutput(w.path, w.fileData)
+	if err != nil {
+		return err
+	}
+	if _, err := w.WriteTo(out); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func validJSON(data []byte, concatenated bool) error {
+	// concatenated or ndjson records and -chunk-array arrays are a sequence
+	// of values rather than one.
+	if !concatenated {
+		var value json.RawMessage
+		return json.Unmarshal(data, &value)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
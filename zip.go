@@ -0,0 +1,82 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+)
+
+func isZip(location string) bool {
+	return !isURL(location) && hasExtension(location, ".zip")
+}
+
+func extractEntry(entry *zip.File, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	reader, err := entry.Open()
+	if err != nil {
+		return fmt.Errorf("Archive entry %s can't be read: %v", entry.Name, err)
+	}
+	defer reader.Close()
+	file, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, reader); err != nil {
+		file.Close()
+		return fmt.Errorf("Archive entry %s can't be read: %v", entry.Name, err)
+	}
+	return file.Close()
+}
+
+func convertZip(fileData inputFile) error {
+	// every .csv entry is copied out to a temporary directory and converted
+	// from there like a file of a directory input. The JSON goes in a
+	// directory named after the archive, or -output, keeping the entry's
+	// own sub directories.
+	archive, err := zip.OpenReader(fileData.filepath)
+	if err != nil {
+		return withExitCode(exitParse, fmt.Errorf("File %s is not a zip archive: %v", fileData.filepath, err))
+	}
+	defer archive.Close()
+	outputDir := fileData.output
+	if outputDir == "" {
+		outputDir = trimExtension(fileData.filepath, ".zip")
+	}
+	tempDir, err := os.MkdirTemp("", "csv-to-json-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+
+	var jobs []fileJob
+	for i, entry := range archive.File {
+		if entry.FileInfo().IsDir() || !hasExtension(entry.Name, ".csv") {
+			continue
+		}
+		job := fileJob{name: entry.Name}
+		// a name such as ../data.csv would be written outside the output
+		// directory.
+		if !filepath.IsLocal(entry.Name) {
+			job.err = fmt.Errorf("Archive entry %s points outside the archive", entry.Name)
+			jobs = append(jobs, job)
+			continue
+		}
+		job.input = filepath.Join(tempDir, strconv.Itoa(i), path.Base(entry.Name))
+		job.output = filepath.Join(outputDir, trimExtension(entry.Name, ".csv")+outputExtension(fileData))
+		job.err = extractEntry(entry, job.input)
+		if job.err == nil {
+			job.err = writeFailure(job.output, os.MkdirAll(filepath.Dir(job.output), 0755))
+		}
+		jobs = append(jobs, job)
+	}
+	if len(jobs) == 0 {
+		return withExitCode(exitNotFound, fmt.Errorf("Archive %s has no CSV files", fileData.filepath))
+	}
+	return runConversions(fileData, jobs)
+}